@@ -1,10 +1,9 @@
 package main
 
 import (
+	"./session"
 	"bytes"
-	"crypto/aes"
 	"encoding/json"
-	"errors"
 	"fmt"
 	box "github.com/nsf/termbox-go"
 	"io/ioutil"
@@ -13,8 +12,7 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
-	"reflect"
-	"sort"
+	"strconv"
 	"time"
 )
 
@@ -25,18 +23,109 @@ func init() {
 const (
 	CONFIG_FILENAME = ".gotunnel.conf"
 
-	sigClose = uint8(0)
-	sigPing  = uint8(1)
+	sigClose      = uint8(0) // abort the connection in both directions
+	sigPing       = uint8(1)
+	sigCloseWrite = uint8(2) // the sender has no more data, like a TCP FIN
+	sigConnected  = uint8(3) // the dial result of server, a socks REP_* and the bound address
+	sigGoAway     = uint8(4) // on the keepalive session: the server is stopping, move to a new comm
 
 	keepaliveSessionMagic = "I am a keepalive session."
+
+	// sent by local with the comm id, sealed with a proof that local has
+	// the token of the comm, see handshake.SealResume: the connection either
+	// replaces all connections of the comm, or is added to them
+	connReplace = uint8(0)
+	connAdd     = uint8(1)
+
+	// the sealed answer of server: the connection is taken; the comm is not
+	// there to resume or add to, and local starts a new one; or the proof is
+	// not of the token of the comm, which a connection replacing the others
+	// may have just changed
+	resumeAccepted = uint8(0)
+	resumeMissing  = uint8(1)
+	resumeStale    = uint8(2)
 )
 
 var (
 	PING_INTERVAL      = time.Second * 5
 	BAD_CONN_THRESHOLD = time.Second * 15
 	CONFIG_FILEPATH    string
+
+	// local waits this long for the handshake with the server, and between
+	// attempts to reach it from RECONNECT_MIN_DELAY, doubling up to
+	// RECONNECT_MAX_DELAY
+	HANDSHAKE_TIMEOUT   = time.Second * 10
+	RECONNECT_MIN_DELAY = time.Second
+	RECONNECT_MAX_DELAY = time.Minute
+
+	// how often local tries to move an idle comm back to a preferred server
+	FAILBACK_INTERVAL = time.Minute
+
+	// sessions are reaped on either side when idle for IDLE_TIMEOUT, or
+	// HALF_CLOSED_TIMEOUT once one direction is closed, and when older
+	// than MAX_LIFETIME; 0 turns a limit off. The config sets them in
+	// seconds with "idle_timeout", "half_closed_timeout" and
+	// "max_lifetime". Sessions are checked every SWEEP_INTERVAL.
+	IDLE_TIMEOUT        = time.Hour
+	HALF_CLOSED_TIMEOUT = time.Minute * 3
+	MAX_LIFETIME        = time.Duration(0)
+	SWEEP_INTERVAL      = time.Second * 10
 )
 
+// reasons for reaping a session
+const (
+	reapIdle       = "idle"
+	reapHalfClosed = "half closed"
+	reapLifetime   = "lifetime"
+)
+
+type sessionPolicy struct {
+	idle       time.Duration
+	halfClosed time.Duration
+	lifetime   time.Duration
+}
+
+// loadSessionPolicy reads the session limits with get, which returns the
+// config value of a key. Limits not set, or set badly, are the defaults;
+// the error tells of the bad ones.
+func loadSessionPolicy(get func(key string) string) (sessionPolicy, error) {
+	policy := sessionPolicy{IDLE_TIMEOUT, HALF_CLOSED_TIMEOUT, MAX_LIFETIME}
+	var err error
+	for key, limit := range map[string]*time.Duration{
+		"idle_timeout":        &policy.idle,
+		"half_closed_timeout": &policy.halfClosed,
+		"max_lifetime":        &policy.lifetime,
+	} {
+		value := get(key)
+		if value == "" {
+			continue
+		}
+		n, e := strconv.Atoi(value)
+		if e != nil || n < 0 {
+			err = fmt.Errorf("bad %s %q", key, value)
+			continue
+		}
+		*limit = time.Second * time.Duration(n)
+	}
+	return policy, err
+}
+
+// reapReason tells why a session is to be reaped at now, or "" if it is
+// not. halfClosed is whether one direction of it is closed.
+func (self sessionPolicy) reapReason(sess *session.Session, halfClosed bool, now time.Time) string {
+	if self.lifetime > 0 && now.Sub(sess.StartTime) > self.lifetime {
+		return reapLifetime
+	}
+	idle := now.Sub(sess.LastActive())
+	if halfClosed && self.halfClosed > 0 && idle > self.halfClosed {
+		return reapHalfClosed
+	}
+	if self.idle > 0 && idle > self.idle {
+		return reapIdle
+	}
+	return ""
+}
+
 func loadConfig(defaultConf map[string]string) map[string]string {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -49,14 +138,27 @@ func loadConfig(defaultConf map[string]string) map[string]string {
 		err = ioutil.WriteFile(CONFIG_FILEPATH, marshalConfig(defaultConf), os.ModePerm)
 		return defaultConf
 	}
-	config := make(map[string]string)
-	err = json.Unmarshal(s, &config)
+	config, err := parseConfig(s)
 	if err != nil {
 		log.Fatal("config file parse error")
 	}
 	return config
 }
 
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+func parseConfig(s []byte) (map[string]string, error) {
+	config := make(map[string]string)
+	err := json.Unmarshal(s, &config)
+	return config, err
+}
+
 func saveConfig(conf map[string]string) {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -93,30 +195,6 @@ func formatFlow(n uint64) string {
 	return ret
 }
 
-func encrypt(key []byte, in []byte) ([]byte, error) {
-	if len(in)%aes.BlockSize != 0 {
-		return nil, errors.New("input data length incorrect")
-	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	out := make([]byte, len(in))
-	for i, l := 0, len(in); i < l; i += aes.BlockSize {
-		block.Encrypt(out[i:i+aes.BlockSize], in[i:i+aes.BlockSize])
-	}
-	return out, nil
-}
-
-func genRandBytes(n int) []byte {
-	buf := new(bytes.Buffer)
-	buf.Grow(n)
-	for i := 0; i < n; i++ {
-		buf.Write([]byte{byte(rand.Intn(256))})
-	}
-	return buf.Bytes()
-}
-
 //func main() {
 //  println(formatFlow(5))
 //  println(formatFlow(1024))
@@ -127,12 +205,6 @@ func genRandBytes(n int) []byte {
 //  println(formatFlow(1024 * 1024 * 1024))
 //  println(formatFlow(1024 * 1024 * 1025 + 1024 * 48))
 //  println(formatFlow(1024 * 1024 * 1025 + 1024 * 48 + 3))
-
-//  key := genRandBytes(24)
-//  in := genRandBytes(64)
-//  enc, err := encrypt(key, in)
-//  if err != nil { log.Fatal(err) }
-//  fmt.Printf("%x\n%x\n", in, enc)
 //}
 
 // from godit
@@ -195,39 +267,3 @@ func (self *Printer) Print(format string, args ...interface{}) {
 		self.x += self.lineWidth
 	}
 }
-
-type sortByValue struct {
-	m   interface{}
-	key reflect.Value
-	fun func(a, b reflect.Value) bool
-}
-
-func (self *sortByValue) Len() int {
-	return reflect.ValueOf(self.m).Len()
-}
-
-func (self *sortByValue) Less(i, j int) bool {
-	v := reflect.ValueOf(self.m)
-	return self.fun(v.MapIndex(self.key.Index(i)),
-		v.MapIndex(self.key.Index(j)))
-}
-
-func (self *sortByValue) Swap(i, j int) {
-	tmp := reflect.ValueOf(self.key.Index(i).Interface())
-	self.key.Index(i).Set(self.key.Index(j))
-	self.key.Index(j).Set(tmp)
-}
-
-func ByValue(m interface{}, fun func(a, b reflect.Value) bool) reflect.Value {
-	sm := new(sortByValue)
-	sm.m = m
-	sm.fun = fun
-	t := reflect.TypeOf(m)
-	v := reflect.ValueOf(m)
-	sm.key = reflect.MakeSlice(reflect.SliceOf(t.Key()), 0, v.Len())
-	for _, key := range v.MapKeys() {
-		sm.key = reflect.Append(sm.key, key)
-	}
-	sort.Sort(sm)
-	return sm.key
-}
@@ -4,7 +4,6 @@ import (
 	"io"
 	"math/rand"
 	"net"
-	"runtime"
 	"sync/atomic"
 	"time"
 
@@ -20,8 +19,7 @@ func init() {
 type ConnReader struct {
 	Events   <-chan Event
 	EventsIn chan Event
-	Count    int32
-	Pool     *BytesPool
+	Count    int32 // connections being read, accessed atomically
 }
 
 const (
@@ -40,16 +38,28 @@ func New() *ConnReader {
 	self := new(ConnReader)
 	self.EventsIn = make(chan Event)
 	self.Events = utils.MakeChan(self.EventsIn).(<-chan Event)
-	self.Pool = NewPool(BUFFER_SIZE)
 	return self
 }
 
-func (self *ConnReader) Add(tcpConn *net.TCPConn, obj interface{}) {
+// Credit gates reading from a connection, so data is not read faster than
+// it can be passed on. WaitCredit blocks until more may be read, and returns
+// false when nothing more will be.
+type Credit interface {
+	WaitCredit() bool
+}
+
+// Add starts reading tcpConn, with events carrying obj. If credit is not
+// nil, each read waits for it; the connection is left alone when it returns
+// false.
+func (self *ConnReader) Add(tcpConn *net.TCPConn, obj interface{}, credit Credit) {
 	atomic.AddInt32(&self.Count, int32(1))
 	go func() {
 		defer atomic.AddInt32(&self.Count, int32(-1))
 		for {
-			buf := self.Pool.Get()
+			if credit != nil && !credit.WaitCredit() {
+				return
+			}
+			buf := make([]byte, BUFFER_SIZE) // kept by the session until acked
 			n, err := tcpConn.Read(buf)
 			if n > 0 {
 				self.EventsIn <- Event{DATA, buf[:n], obj}
@@ -69,35 +79,3 @@ func (self *ConnReader) Add(tcpConn *net.TCPConn, obj interface{}) {
 func (self *ConnReader) Close() {
 	close(self.EventsIn)
 }
-
-type BytesPool struct {
-	pool   chan []byte
-	size   int
-	Reuses int
-	Allocs int
-}
-
-func NewPool(size int) *BytesPool {
-	return &BytesPool{
-		size: size,
-		pool: make(chan []byte, 10240),
-	}
-}
-
-func (self *BytesPool) Get() []byte {
-	var bs []byte
-	select {
-	case bs = <-self.pool:
-		self.Reuses++
-	default:
-		self.Allocs++
-		bs = make([]byte, self.size)
-	}
-	runtime.SetFinalizer(&bs, func(bs *[]byte) {
-		select {
-		case self.pool <- *bs:
-		default:
-		}
-	})
-	return bs
-}
@@ -3,7 +3,9 @@ package conn_reader
 import (
 	"fmt"
 	"net"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type objT struct {
@@ -13,23 +15,21 @@ type objT struct {
 
 func TestConnReader(t *testing.T) {
 	reader := New()
-	addr, _ := net.ResolveTCPAddr("tcp", "localhost:54322")
-	ready := make(chan struct{})
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	addr := ln.Addr().(*net.TCPAddr)
 	go func() {
-		ln, err := net.ListenTCP("tcp", addr)
-		if err != nil {
-			t.Fatal(err)
-		}
-		close(ready)
 		for {
 			conn, err := ln.AcceptTCP()
-			if err != nil {
-				t.Fatal(err)
+			if err != nil { // closed
+				return
 			}
-			reader.Add(conn, objT{"hello", conn})
+			reader.Add(conn, objT{"hello", conn}, nil)
 		}
 	}()
-	<-ready
 	n := 512
 	for i := 0; i < n; i++ {
 		conn, err := net.DialTCP("tcp", nil, addr)
@@ -59,7 +59,11 @@ func TestConnReader(t *testing.T) {
 			break
 		}
 	}
-	if reader.Count != 0 {
-		t.Fail()
+	// readers count down after sending EOF
+	for i := 0; atomic.LoadInt32(&reader.Count) != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d connections still read", atomic.LoadInt32(&reader.Count))
+		}
+		time.Sleep(time.Millisecond * 10)
 	}
 }
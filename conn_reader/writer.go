@@ -0,0 +1,85 @@
+package conn_reader
+
+import (
+	"net"
+	"sync"
+)
+
+// Writer writes to a connection in a goroutine of its own, so a slow
+// connection holds up nothing but itself. Writes are queued without bound;
+// the window of the session the data comes from bounds them. written is
+// called from that goroutine with the length of each write done.
+type Writer struct {
+	conn       *net.TCPConn
+	written    func(n int)
+	lock       sync.Mutex
+	cond       *sync.Cond
+	queue      [][]byte
+	closeWrite bool
+	closed     bool
+}
+
+func NewWriter(conn *net.TCPConn, written func(n int)) *Writer {
+	self := &Writer{
+		conn:    conn,
+		written: written,
+	}
+	self.cond = sync.NewCond(&self.lock)
+	go self.start()
+	return self
+}
+
+// Write queues data to be written
+func (self *Writer) Write(data []byte) {
+	self.lock.Lock()
+	self.queue = append(self.queue, data)
+	self.cond.Signal()
+	self.lock.Unlock()
+}
+
+// CloseWrite closes the write side of the connection once the data queued
+// is written
+func (self *Writer) CloseWrite() {
+	self.lock.Lock()
+	self.closeWrite = true
+	self.cond.Signal()
+	self.lock.Unlock()
+}
+
+// Close closes the connection once the data queued is written. written is
+// not called after Close returns; to drop the data queued, close the
+// connection first.
+func (self *Writer) Close() {
+	self.lock.Lock()
+	self.closed = true
+	self.cond.Signal()
+	self.lock.Unlock()
+}
+
+func (self *Writer) start() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for {
+		for len(self.queue) == 0 && !self.closeWrite && !self.closed {
+			self.cond.Wait()
+		}
+		if len(self.queue) == 0 {
+			if self.closed {
+				self.conn.Close()
+				return
+			}
+			self.conn.CloseWrite()
+			self.closeWrite = false
+			continue
+		}
+		data := self.queue[0]
+		self.queue[0] = nil
+		self.queue = self.queue[1:]
+		self.lock.Unlock()
+		self.conn.Write(data) // on error the reader of the conn sees it too
+		self.lock.Lock()
+		if !self.closed {
+			self.written(len(data))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package conn_reader
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan []byte)
+	go func() {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		time.Sleep(time.Millisecond * 100) // a slow reader
+		data, _ := ioutil.ReadAll(conn)    // until the write side is closed
+		received <- data
+	}()
+	conn, err := net.DialTCP("tcp", nil, ln.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written int64
+	writer := NewWriter(conn, func(n int) {
+		atomic.AddInt64(&written, int64(n))
+	})
+	var expected []byte
+	for i := 0; i < 256; i++ {
+		data := bytes.Repeat([]byte{byte(i)}, 4096)
+		expected = append(expected, data...)
+		writer.Write(data) // does not wait for the reader
+	}
+	writer.CloseWrite()
+	select {
+	case data := <-received:
+		if !bytes.Equal(data, expected) {
+			t.Fatalf("%d bytes received, %d written", len(data), len(expected))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+	if n := atomic.LoadInt64(&written); n != int64(len(expected)) {
+		t.Fatalf("%d bytes reported written, %d expected", n, len(expected))
+	}
+	writer.Close()
+}
@@ -0,0 +1,347 @@
+package handshake
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	KEY_LENGTH      = 32
+	MAC_LENGTH      = sha256.Size
+	MAX_USER_LENGTH = 255
+
+	sealedOfferLength = 2 + 4 + 16 // version, features, tag
+
+	SEALED_RESUME_LENGTH = 8 + 1 + MAC_LENGTH + 16 // id, mode, proof, tag
+	SEALED_STATUS_LENGTH = 1 + 16                  // status, tag
+)
+
+var (
+	ErrAuth    = errors.New("handshake: authentication failed")
+	ErrUser    = errors.New("handshake: user name too long")
+	ErrVersion = errors.New("handshake: no common protocol version")
+)
+
+// Keys are the per-connection keys for each direction, and the protocol
+// version and features both sides agreed on for the connection. Token is a
+// secret both sides share, to resume a Comm started on this connection.
+type Keys struct {
+	Send     []byte
+	Recv     []byte
+	Token    []byte
+	Version  uint16
+	Features uint32
+
+	// for the resume request of the client and the status answering it
+	resumeSeal cipher.AEAD
+	statusSeal cipher.AEAD
+}
+
+// secrets derived from one handshake
+type secrets struct {
+	clientMac  []byte
+	serverMac  []byte
+	clientSeal cipher.AEAD
+	serverSeal cipher.AEAD
+	resumeSeal cipher.AEAD
+	statusSeal cipher.AEAD
+	c2s        []byte
+	s2c        []byte
+	token      []byte
+}
+
+// Client runs the handshake as the connecting side, identifying as user and
+// offering the highest protocol version it speaks and the features it asks
+// for.
+//
+//	client -> server  user name length, user name, client ephemeral public key
+//	server -> client  server ephemeral public key
+//	client -> server  client mac, sealed version and features offered
+//	server -> client  server mac, sealed version and features granted
+//
+// These messages must stay as they are in every protocol version, so that
+// any client and server can agree on a version; the server grants version 0
+// to refuse the client.
+//
+// Both macs are keyed with the X25519 shared secret mixed with the user's
+// pre-shared key, so each side proves knowledge of the pre-shared key and of
+// this connection's ephemeral keys. A recorded handshake cannot be replayed
+// because the other side's ephemeral key is fresh every time. Versions and
+// features are sealed with keys from the same secret, so an observer cannot
+// tell them.
+func Client(conn io.ReadWriter, user string, psk []byte, version uint16, features uint32) (*Keys, error) {
+	if len(user) > MAX_USER_LENGTH {
+		return nil, ErrUser
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	clientPub := priv.PublicKey().Bytes()
+	hello := append([]byte{byte(len(user))}, user...)
+	if _, err = conn.Write(append(hello, clientPub...)); err != nil {
+		return nil, err
+	}
+	serverPub := make([]byte, KEY_LENGTH)
+	if _, err = io.ReadFull(conn, serverPub); err != nil {
+		return nil, err
+	}
+	s, err := derive(priv, serverPub, psk, user, clientPub, serverPub)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(append(s.clientMac, sealOffer(s.clientSeal, version, features)...)); err != nil {
+		return nil, err
+	}
+	serverMac := make([]byte, MAC_LENGTH+sealedOfferLength)
+	if _, err = io.ReadFull(conn, serverMac); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(serverMac[:MAC_LENGTH], s.serverMac) {
+		return nil, ErrAuth
+	}
+	version, granted, err := openOffer(s.serverSeal, serverMac[MAC_LENGTH:])
+	if err != nil {
+		return nil, err
+	}
+	if version == 0 {
+		return nil, ErrVersion
+	}
+	return &Keys{Send: s.c2s, Recv: s.s2c, Token: s.token, Version: version, Features: granted,
+		resumeSeal: s.resumeSeal, statusSeal: s.statusSeal}, nil
+}
+
+// Server runs the handshake as the accepting side. lookup returns the
+// pre-shared key of a user, or nil if there is no such user. negotiate
+// returns the protocol version and features granted to a user who offered a
+// version and asked for features, version 0 if it speaks no version the
+// server does. The name of the authenticated user is returned with the
+// keys.
+func Server(conn io.ReadWriter, lookup func(user string) []byte, negotiate func(user string, version uint16, features uint32) (uint16, uint32)) (*Keys, string, error) {
+	var userLength [1]byte
+	if _, err := io.ReadFull(conn, userLength[:]); err != nil {
+		return nil, "", err
+	}
+	userBytes := make([]byte, userLength[0])
+	if _, err := io.ReadFull(conn, userBytes); err != nil {
+		return nil, "", err
+	}
+	user := string(userBytes)
+	clientPub := make([]byte, KEY_LENGTH)
+	if _, err := io.ReadFull(conn, clientPub); err != nil {
+		return nil, "", err
+	}
+	psk := lookup(user)
+	if psk == nil { // unknown user, fail at the mac like a wrong key
+		psk = make([]byte, KEY_LENGTH)
+		rand.Read(psk)
+	}
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	serverPub := priv.PublicKey().Bytes()
+	if _, err = conn.Write(serverPub); err != nil {
+		return nil, "", err
+	}
+	s, err := derive(priv, clientPub, psk, user, clientPub, serverPub)
+	if err != nil {
+		return nil, "", err
+	}
+	clientMac := make([]byte, MAC_LENGTH+sealedOfferLength)
+	if _, err = io.ReadFull(conn, clientMac); err != nil {
+		return nil, "", err
+	}
+	if !hmac.Equal(clientMac[:MAC_LENGTH], s.clientMac) {
+		return nil, "", ErrAuth
+	}
+	version, asked, err := openOffer(s.clientSeal, clientMac[MAC_LENGTH:])
+	if err != nil {
+		return nil, "", err
+	}
+	version, granted := negotiate(user, version, asked)
+	if version == 0 {
+		granted = 0
+	}
+	if _, err = conn.Write(append(s.serverMac, sealOffer(s.serverSeal, version, granted)...)); err != nil {
+		return nil, "", err
+	}
+	if version == 0 {
+		return nil, user, ErrVersion
+	}
+	return &Keys{Send: s.s2c, Recv: s.c2s, Token: s.token, Version: version, Features: granted,
+		resumeSeal: s.resumeSeal, statusSeal: s.statusSeal}, user, nil
+}
+
+func derive(priv *ecdh.PrivateKey, peerPub, psk []byte, user string, clientPub, serverPub []byte) (*secrets, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerPub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	transcript := append([]byte{byte(len(user))}, user...)
+	transcript = append(append(transcript, clientPub...), serverPub...)
+	master, err := hkdf.Extract(sha256.New, append(shared, psk...), transcript)
+	if err != nil {
+		return nil, err
+	}
+	s := new(secrets)
+	var clientSeal, serverSeal, resumeSeal, statusSeal []byte
+	for _, out := range []struct {
+		p    *[]byte
+		info string
+	}{
+		{&s.clientMac, "gotunnel client mac"},
+		{&s.serverMac, "gotunnel server mac"},
+		{&clientSeal, "gotunnel client offer"},
+		{&serverSeal, "gotunnel server offer"},
+		{&resumeSeal, "gotunnel client resume"},
+		{&statusSeal, "gotunnel server status"},
+		{&s.c2s, "gotunnel client to server"},
+		{&s.s2c, "gotunnel server to client"},
+		{&s.token, "gotunnel resumption token"},
+	} {
+		*out.p, err = hkdf.Expand(sha256.New, master, out.info, KEY_LENGTH)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the macs are over the transcript, keyed with the derived mac keys
+	s.clientMac = mac(s.clientMac, transcript)
+	s.serverMac = mac(s.serverMac, transcript)
+	if s.clientSeal, err = newAEAD(clientSeal); err != nil {
+		return nil, err
+	}
+	if s.serverSeal, err = newAEAD(serverSeal); err != nil {
+		return nil, err
+	}
+	if s.resumeSeal, err = newAEAD(resumeSeal); err != nil {
+		return nil, err
+	}
+	if s.statusSeal, err = newAEAD(statusSeal); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ResumeProof proves knowledge of token, the Token of the connection that
+// started a Comm, on the connection of keys. The proof does not give the
+// token away and is no good on any other connection.
+func ResumeProof(token []byte, keys *Keys) []byte {
+	return mac(token, keys.Token)
+}
+
+// CheckResume tells if proof, sent on the connection of keys, is the
+// ResumeProof of token.
+func CheckResume(token, proof []byte, keys *Keys) bool {
+	return hmac.Equal(proof, ResumeProof(token, keys))
+}
+
+// Resumption is the token of a Comm as the server keeps it. A connection
+// replacing the others binds the Comm to its own token, which the client
+// takes too.
+type Resumption struct {
+	lock  sync.Mutex
+	token []byte
+}
+
+// NewResumption binds a Comm to the token of keys, those of the connection
+// that started it.
+func NewResumption(keys *Keys) *Resumption {
+	return &Resumption{token: keys.Token}
+}
+
+// Resume checks proof, sent on the connection of keys, and with replace
+// binds the Comm to the token of keys. A proof of a token replaced already
+// fails, so a client adding a connection while it replaced the others tries
+// again with the new token.
+func (self *Resumption) Resume(keys *Keys, proof []byte, replace bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !CheckResume(self.token, proof, keys) {
+		return false
+	}
+	if replace {
+		self.token = keys.Token
+	}
+	return true
+}
+
+// SealResume seals what the client sends right after the handshake: id, the
+// Comm to resume or start, mode, and the ResumeProof of token. Each
+// connection seals one, so an observer cannot link the connections of a
+// Comm by its id.
+func SealResume(keys *Keys, id int64, mode uint8, token []byte) []byte {
+	buf := make([]byte, 9, 9+MAC_LENGTH)
+	binary.LittleEndian.PutUint64(buf, uint64(id))
+	buf[8] = mode
+	buf = append(buf, ResumeProof(token, keys)...)
+	return keys.resumeSeal.Seal(nil, make([]byte, keys.resumeSeal.NonceSize()), buf, nil)
+}
+
+// OpenResume opens what SealResume sealed on the other side of the
+// connection of keys, returning the id, the mode and the proof.
+func OpenResume(keys *Keys, sealed []byte) (int64, uint8, []byte, error) {
+	buf, err := keys.resumeSeal.Open(nil, make([]byte, keys.resumeSeal.NonceSize()), sealed, nil)
+	if err != nil || len(buf) != 9+MAC_LENGTH {
+		return 0, 0, nil, ErrAuth
+	}
+	return int64(binary.LittleEndian.Uint64(buf)), buf[8], buf[9:], nil
+}
+
+// SealStatus seals the answer of the server to the resume request.
+func SealStatus(keys *Keys, status uint8) []byte {
+	return keys.statusSeal.Seal(nil, make([]byte, keys.statusSeal.NonceSize()), []byte{status}, nil)
+}
+
+// OpenStatus opens what SealStatus sealed on the other side of the
+// connection of keys.
+func OpenStatus(keys *Keys, sealed []byte) (uint8, error) {
+	buf, err := keys.statusSeal.Open(nil, make([]byte, keys.statusSeal.NonceSize()), sealed, nil)
+	if err != nil || len(buf) != 1 {
+		return 0, ErrAuth
+	}
+	return buf[0], nil
+}
+
+func mac(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// each seal key is used once, so a zero nonce is fine
+func sealOffer(aead cipher.AEAD, version uint16, features uint32) []byte {
+	buf := make([]byte, 6)
+	binary.LittleEndian.PutUint16(buf, version)
+	binary.LittleEndian.PutUint32(buf[2:], features)
+	return aead.Seal(nil, make([]byte, aead.NonceSize()), buf, nil)
+}
+
+func openOffer(aead cipher.AEAD, sealed []byte) (uint16, uint32, error) {
+	buf, err := aead.Open(nil, make([]byte, aead.NonceSize()), sealed, nil)
+	if err != nil {
+		return 0, 0, ErrAuth
+	}
+	return binary.LittleEndian.Uint16(buf), binary.LittleEndian.Uint32(buf[2:]), nil
+}
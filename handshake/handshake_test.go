@@ -0,0 +1,261 @@
+package handshake
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func lookup(keys map[string]string) func(string) []byte {
+	return func(user string) []byte {
+		key, ok := keys[user]
+		if !ok {
+			return nil
+		}
+		return []byte(key)
+	}
+}
+
+// speaks versions 2 to 4 and grants only the first feature
+func negotiate(user string, version uint16, features uint32) (uint16, uint32) {
+	if version > 4 {
+		version = 4
+	}
+	if version < 2 {
+		return 0, 0
+	}
+	return version, features & 1
+}
+
+func run(user string, clientKey []byte, serverKeys map[string]string) (*Keys, *Keys, string, error, error) {
+	return runVersion(user, clientKey, serverKeys, 3)
+}
+
+func runVersion(user string, clientKey []byte, serverKeys map[string]string, version uint16) (*Keys, *Keys, string, error, error) {
+	conn1, conn2 := net.Pipe()
+	defer conn1.Close()
+	defer conn2.Close()
+	var keys *Keys
+	var serverUser string
+	var serverErr error
+	done := make(chan struct{})
+	go func() {
+		keys, serverUser, serverErr = Server(conn2, lookup(serverKeys), negotiate)
+		conn2.Close()
+		close(done)
+	}()
+	clientKeys, clientErr := Client(conn1, user, clientKey, version, 3)
+	conn1.Close()
+	<-done
+	return clientKeys, keys, serverUser, clientErr, serverErr
+}
+
+func TestHandshake(t *testing.T) {
+	psk := []byte("foo bar baz foo bar baz ")
+	users := map[string]string{"alice": string(psk), "bob": "bar"}
+	c1, s1, user, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if user != "alice" {
+		t.Fatal("user not match")
+	}
+	if c1.Features != 1 || s1.Features != 1 {
+		t.Fatal("features not match")
+	}
+	if c1.Version != 3 || s1.Version != 3 {
+		t.Fatal("version not match")
+	}
+	if !bytes.Equal(c1.Send, s1.Recv) || !bytes.Equal(c1.Recv, s1.Send) {
+		t.Fatal("keys not match")
+	}
+	if bytes.Equal(c1.Send, c1.Recv) {
+		t.Fatal("same key for both directions")
+	}
+	c2, _, _, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if bytes.Equal(c1.Send, c2.Send) {
+		t.Fatal("keys reused across connections")
+	}
+}
+
+func TestHandshakeWrongKey(t *testing.T) {
+	users := map[string]string{"alice": "foo", "bob": "bar"}
+	_, _, _, err1, err2 := run("alice", []byte("bar"), users)
+	if err1 == nil || err2 != ErrAuth {
+		t.Fatal("wrong key accepted", err1, err2)
+	}
+	_, _, _, err1, err2 = run("carol", []byte("bar"), users)
+	if err1 == nil || err2 != ErrAuth {
+		t.Fatal("unknown user accepted", err1, err2)
+	}
+}
+
+// recorder records what the client sends
+type recorder struct {
+	io.ReadWriter
+	written bytes.Buffer
+}
+
+func (self *recorder) Write(b []byte) (int, error) {
+	self.written.Write(b)
+	return self.ReadWriter.Write(b)
+}
+
+func TestHandshakeReplay(t *testing.T) {
+	psk := []byte("foo bar baz foo bar baz ")
+	users := lookup(map[string]string{"alice": string(psk)})
+	conn1, conn2 := net.Pipe()
+	go Server(conn2, users, negotiate)
+	rec := &recorder{ReadWriter: conn1}
+	if _, err := Client(rec, "alice", psk, 3, 0); err != nil {
+		t.Fatal(err)
+	}
+	conn1.Close()
+	conn2.Close()
+
+	// replay the recorded client messages to a new server
+	conn1, conn2 = net.Pipe()
+	defer conn1.Close()
+	result := make(chan error)
+	go func() {
+		_, _, err := Server(conn2, users, negotiate)
+		conn2.Close()
+		result <- err
+	}()
+	go io.Copy(io.Discard, conn1)
+	conn1.Write(rec.written.Bytes())
+	if err := <-result; err != ErrAuth {
+		t.Fatal("replayed handshake accepted", err)
+	}
+}
+
+func TestHandshakeVersion(t *testing.T) {
+	psk := []byte("foo bar baz foo bar baz ")
+	users := map[string]string{"alice": string(psk)}
+	// a newer client gets the newest version of the server
+	c, s, _, err1, err2 := runVersion("alice", psk, users, 7)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if c.Version != 4 || s.Version != 4 {
+		t.Fatal("version not match")
+	}
+	// a client too old is refused on both sides
+	_, _, _, err1, err2 = runVersion("alice", psk, users, 1)
+	if err1 != ErrVersion || err2 != ErrVersion {
+		t.Fatal("old client accepted", err1, err2)
+	}
+}
+
+func TestResume(t *testing.T) {
+	psk := []byte("foo bar baz foo bar baz ")
+	users := map[string]string{"alice": string(psk)}
+	c1, s1, _, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if !bytes.Equal(c1.Token, s1.Token) {
+		t.Fatal("tokens not match")
+	}
+	c2, s2, _, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if bytes.Equal(c1.Token, c2.Token) {
+		t.Fatal("token reused across connections")
+	}
+	// the second connection resumes what the first started
+	proof := ResumeProof(c1.Token, c2)
+	if !CheckResume(s1.Token, proof, s2) {
+		t.Fatal("resumption rejected")
+	}
+	if CheckResume(s2.Token, proof, s2) {
+		t.Fatal("wrong token accepted")
+	}
+	// a proof is no good on another connection
+	_, s3, _, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	if CheckResume(s1.Token, proof, s3) {
+		t.Fatal("replayed proof accepted")
+	}
+}
+
+func TestSealResume(t *testing.T) {
+	psk := []byte("foo bar baz foo bar baz ")
+	users := map[string]string{"alice": string(psk)}
+	c1, s1, _, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	c2, s2, _, err1, err2 := run("alice", psk, users)
+	if err1 != nil || err2 != nil {
+		t.Fatal(err1, err2)
+	}
+	sealed := SealResume(c2, 42, 1, c1.Token)
+	if len(sealed) != SEALED_RESUME_LENGTH {
+		t.Fatalf("sealed resume of %d bytes", len(sealed))
+	}
+	id, mode, proof, err := OpenResume(s2, sealed)
+	if err != nil || id != 42 || mode != 1 {
+		t.Fatal("resume not match", id, mode, err)
+	}
+	if !CheckResume(s1.Token, proof, s2) {
+		t.Fatal("resumption rejected")
+	}
+	// sealed for one connection only
+	if _, _, _, err = OpenResume(s1, sealed); err != ErrAuth {
+		t.Fatal("resume opened on another connection")
+	}
+	sealed[0] ^= 1
+	if _, _, _, err = OpenResume(s2, sealed); err != ErrAuth {
+		t.Fatal("tampered resume opened")
+	}
+
+	sealed = SealStatus(s2, 1)
+	if len(sealed) != SEALED_STATUS_LENGTH {
+		t.Fatalf("sealed status of %d bytes", len(sealed))
+	}
+	if status, err := OpenStatus(c2, sealed); err != nil || status != 1 {
+		t.Fatal("status not match", status, err)
+	}
+	if _, err := OpenStatus(c1, sealed); err != ErrAuth {
+		t.Fatal("status opened on another connection")
+	}
+}
+
+func TestResumeRace(t *testing.T) {
+	psk := []byte("foo bar baz foo bar baz ")
+	users := map[string]string{"alice": string(psk)}
+	var client, server [3]*Keys
+	for i := range client {
+		var err1, err2 error
+		client[i], server[i], _, err1, err2 = run("alice", psk, users)
+		if err1 != nil || err2 != nil {
+			t.Fatal(err1, err2)
+		}
+	}
+	// connection 1 replaces the connections of the comm connection 0
+	// started while connection 2 is added to it, both proving the token
+	// of connection 0
+	for i := 0; i < 100; i++ {
+		resumption := NewResumption(server[0])
+		replaced := make(chan bool)
+		go func() {
+			replaced <- resumption.Resume(server[1], ResumeProof(client[0].Token, client[1]), true)
+		}()
+		added := resumption.Resume(server[2], ResumeProof(client[0].Token, client[2]), false)
+		if !<-replaced {
+			t.Fatal("replace rejected")
+		}
+		// an add after the replace tries again with the new token
+		if !added && !resumption.Resume(server[2], ResumeProof(client[1].Token, client[2]), false) {
+			t.Fatal("add with the new token rejected")
+		}
+	}
+}
@@ -2,31 +2,44 @@ package main
 
 import (
 	cr "./conn_reader"
+	"./handshake"
 	"./session"
 	"./socks"
-	"encoding/binary"
+	"./transport"
+	"errors"
 	"fmt"
 	box "github.com/nsf/termbox-go"
+	"io"
+	"io/ioutil"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"reflect"
+	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // configuration
 var defaultConfig = map[string]string{
-	"local":  "localhost:23456",
-	"remote": "localhost:34567",
-	"key":    "foo bar baz foo bar baz ",
+	"local":     "localhost:23456",
+	"remote":    "localhost:34567",
+	"key":       "foo bar baz foo bar baz ",
+	"transport": "tcp",
 }
 var globalConfig = loadConfig(defaultConfig)
 
+// settings read once at start, a reload leaves them as they are
+var restartConfig = []string{"user", "transport", "obfuscate", "compress", "tls_server_name", "tls_pin", "tls_ca", "ws_path"}
+
 func checkConfig(key string) {
 	if value, ok := globalConfig[key]; !ok || value == "" {
 		globalConfig[key] = defaultConfig[key]
@@ -38,6 +51,7 @@ func init() {
 	checkConfig("local")
 	checkConfig("remote")
 	checkConfig("key")
+	checkConfig("transport")
 
 	rand.Seed(time.Now().UnixNano())
 	go func() {
@@ -47,10 +61,12 @@ func init() {
 
 type Serv struct {
 	session      *session.Session
+	socksClient  *socks.Client
 	clientConn   *net.TCPConn
+	writer       *cr.Writer
 	hostPort     string
-	localClosed  bool
-	remoteClosed bool
+	localClosed  bool // client sent EOF, passed on with sigCloseWrite
+	remoteClosed bool // server sent sigCloseWrite
 	closeOnce    sync.Once
 }
 
@@ -93,39 +109,358 @@ func main() {
 	clientReader := cr.New()
 	defer clientReader.Close()
 
-	// connect to remote server
-	addr, err := net.ResolveTCPAddr("tcp", globalConfig["remote"])
+	// connect to remote servers, as user over trans with features, which
+	// stay as they are until a restart
+	user := globalConfig["user"]
+	trans, err := transport.New(globalConfig["transport"], globalConfig)
 	if err != nil {
-		log.Fatal("cannot resolve remote addr ", err)
+		log.Fatal(err)
+	}
+	features := uint32(0)
+	if globalConfig["obfuscate"] == "on" {
+		features |= session.FEATURE_OBFUSCATION
+	}
+	if globalConfig["compress"] == "on" {
+		features |= session.FEATURE_COMPRESSION
+	}
+	features |= session.FEATURE_PRIORITY
+	// the settings a reload of the config changes
+	var servers []remote
+	var priorityPorts map[string]bool
+	var connections, reconnectLimit int
+	var policy sessionPolicy
+	applyConfig := func(config map[string]string) {
+		servers = remotes(config)
+		// sessions to these ports, interactive ones, go before bulk transfers
+		priorityPorts = make(map[string]bool)
+		ports, ok := config["priority_ports"]
+		if !ok {
+			ports = "22"
+		}
+		for _, port := range strings.Split(ports, ",") {
+			priorityPorts[strings.TrimSpace(port)] = true
+		}
+		// parallel connections to the server
+		var err error
+		connections, err = strconv.Atoi(config["connections"])
+		if err != nil || connections < 1 {
+			connections = 1
+		}
+		// limits of sessions, reaped when stale
+		policy, _ = loadSessionPolicy(func(key string) string { return config[key] })
+		// attempts to reach the servers before giving up, 0 for no limit
+		reconnectLimit, err = strconv.Atoi(config["reconnect_limit"])
+		if err != nil || reconnectLimit < 0 {
+			reconnectLimit = 0
+		}
 	}
+	applyConfig(globalConfig)
+	if len(servers) == 0 {
+		log.Fatalf("no server in remote %q of %s", globalConfig["remote"], CONFIG_FILEPATH)
+	}
+	// the comm, the server it is on, its id and the token to resume it,
+	// taken from the last connection replacing the others
+	var comm *session.Comm
+	current := servers[0]
 	commId := rand.Int63()
-	cipherKey := []byte(globalConfig["key"])
-	getServerConn := func() *net.TCPConn {
-		serverConn, err := net.DialTCP("tcp", nil, addr)
+	var token []byte
+	// the server does not have the comm to resume or add to, or the token
+	// local proved is not the one of the comm
+	errMissing := errors.New("comm not on the server")
+	errStale := errors.New("comm token stale")
+	getServerConn := func(to remote, id int64, token []byte, mode uint8) (net.Conn, *handshake.Keys, error) {
+		addr := to.addr
+		serverConn, err := trans.Dial(addr)
 		if err != nil {
-			log.Fatal("cannot connect to remote server ", err)
+			return nil, nil, fmt.Errorf("cannot connect to remote server %s %v", addr, err)
 		}
 		// auth
-		origin := genRandBytes(64)
-		encrypted, err := encrypt(cipherKey, origin)
+		serverConn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+		keys, err := handshake.Client(serverConn, user, to.psk, session.PROTOCOL_VERSION, features)
+		if err == handshake.ErrVersion { // the server is skipped like one down
+			serverConn.Close()
+			return nil, nil, fmt.Errorf("server protocol version not supported %s", addr)
+		}
+		if err != nil {
+			serverConn.Close()
+			return nil, nil, fmt.Errorf("auth fail %s %v", addr, err)
+		}
+		if keys.Version < session.MIN_PROTOCOL_VERSION {
+			serverConn.Close()
+			return nil, nil, fmt.Errorf("server protocol version too old %s %d", addr, keys.Version)
+		}
+		// send comm id, mode and proof, and hear if the server takes them
+		_, err = serverConn.Write(handshake.SealResume(keys, id, mode, token))
 		if err != nil {
-			log.Fatal(err)
+			serverConn.Close()
+			return nil, nil, fmt.Errorf("cannot connect to remote server %s %v", addr, err)
 		}
-		serverConn.Write(origin)
-		serverConn.Write(encrypted)
-		var response byte
-		err = binary.Read(serverConn, binary.LittleEndian, &response)
-		if err != nil || response != byte(1) {
-			log.Fatal("auth fail ", err)
+		sealed := make([]byte, handshake.SEALED_STATUS_LENGTH)
+		if _, err = io.ReadFull(serverConn, sealed); err != nil {
+			serverConn.Close()
+			return nil, nil, fmt.Errorf("cannot connect to remote server %s %v", addr, err)
 		}
-		// sent comm id
-		binary.Write(serverConn, binary.LittleEndian, commId)
-		return serverConn
+		status, err := handshake.OpenStatus(keys, sealed)
+		if err != nil {
+			serverConn.Close()
+			return nil, nil, fmt.Errorf("auth fail %s %v", addr, err)
+		}
+		switch status {
+		case resumeAccepted:
+		case resumeMissing:
+			serverConn.Close()
+			return nil, nil, errMissing
+		default:
+			serverConn.Close()
+			return nil, nil, errStale
+		}
+		serverConn.SetDeadline(time.Time{})
+		return serverConn, keys, nil
+	}
+	// a connection to a server, for the comm with id
+	type serverConn struct {
+		server  remote
+		id      int64
+		conn    net.Conn
+		keys    *handshake.Keys
+		missing bool // the server does not have the comm
+	}
+	// connect tries until connected, waiting longer after each round. The
+	// comm is resumed on its server if that answers and is still in the
+	// list, else a new comm is started on the first other server in the
+	// list that does.
+	reconnectAttempt := int64(0) // 0 when connected
+	connect := func(servers []remote, current remote, id int64, token []byte, limit int) serverConn {
+		var order []remote
+		if position(servers, current.addr) < len(servers) {
+			order = append(order, current)
+		}
+		for _, s := range servers {
+			if s.addr != current.addr {
+				order = append(order, s)
+			}
+		}
+		delay := RECONNECT_MIN_DELAY
+		for attempt := 1; ; attempt++ {
+			atomic.StoreInt64(&reconnectAttempt, int64(attempt))
+			var err error
+			for _, s := range order {
+				c := serverConn{server: s, id: id}
+				if s.addr != current.addr {
+					c.id = rand.Int63()
+				}
+				c.conn, c.keys, err = getServerConn(s, c.id, token, connReplace)
+				if err == errMissing || err == errStale { // the comm cannot be resumed, start a new one there
+					id, token = rand.Int63(), nil
+					c.id = id
+					c.conn, c.keys, err = getServerConn(s, c.id, token, connReplace)
+				}
+				if err == nil {
+					return c
+				}
+			}
+			if limit > 0 && attempt >= limit {
+				log.Fatal(err)
+			}
+			time.Sleep(delay/2 + time.Duration(rand.Int63n(int64(delay))))
+			delay *= 2
+			if delay > RECONNECT_MAX_DELAY {
+				delay = RECONNECT_MAX_DELAY
+			}
+		}
+	}
+	reconnected := make(chan serverConn)
+	// reconnect resumes the comm, or with fresh, starts a new one
+	reconnect := func(fresh bool) {
+		if atomic.LoadInt64(&reconnectAttempt) > 0 { // already reconnecting
+			return
+		}
+		atomic.StoreInt64(&reconnectAttempt, 1)
+		id, tok := commId, token
+		if fresh {
+			id, tok = rand.Int63(), nil
+		}
+		go func(servers []remote, current remote, id int64, token []byte, limit int) {
+			reconnected <- connect(servers, current, id, token, limit)
+		}(servers, current, id, tok, reconnectLimit)
 	}
-	comm := session.NewComm(getServerConn(), cipherKey)
-
 	// keepalive
-	keepaliveSession := comm.NewSession(-1, []byte(keepaliveSessionMagic), nil)
+	var keepaliveSession *session.Session
+	// comms of servers going away, kept until their sessions are done
+	type drainingComm struct {
+		comm      *session.Comm
+		keepalive *session.Session
+	}
+	var draining []drainingComm
+	drainEvents := make(chan session.Event)
+	goneAway := false // the server of the comm is going away
+	// useConn resumes the comm on a connection, or starts a new comm on it
+	// in place of the old one, which drains if its server is going away and
+	// is closed with its sessions if not
+	useConn := func(c serverConn) {
+		if comm != nil && c.id == commId {
+			comm.UseConn(c.conn, c.keys.Send, c.keys.Recv, c.keys.Features)
+		} else {
+			if comm != nil && goneAway {
+				draining = append(draining, drainingComm{comm, keepaliveSession})
+				go func(comm *session.Comm) {
+					for ev := range comm.Events {
+						drainEvents <- ev
+					}
+				}(comm)
+			} else if comm != nil {
+				closeComm(comm)
+			}
+			comm = session.NewComm(c.conn, c.keys.Send, c.keys.Recv, c.keys.Features)
+			keepaliveSession = comm.NewSession(-1, []byte(keepaliveSessionMagic), nil)
+		}
+		current, commId, token = c.server, c.id, c.keys.Token
+		goneAway = false
+		atomic.StoreInt64(&reconnectAttempt, 0)
+	}
+	useConn(connect(servers, current, commId, nil, reconnectLimit))
+	// addConns dials the connections the comm lacks in a goroutine, which
+	// delivers them on addedConn and a zero serverConn when done
+	addedConn := make(chan serverConn)
+	addingConns := false
+	addConns := func() {
+		n := connections - comm.Conns()
+		if addingConns || n <= 0 {
+			return
+		}
+		addingConns = true
+		go func(to remote, id int64, token []byte) {
+			for i := 0; i < n; i++ {
+				c := serverConn{server: to, id: id}
+				var err error
+				c.conn, c.keys, err = getServerConn(to, id, token, connAdd)
+				if err == errMissing { // the comm is gone
+					addedConn <- serverConn{id: id, missing: true}
+					break
+				}
+				if err != nil { // tried again on the next heartbeat, with the token of a replace done meanwhile
+					break
+				}
+				addedConn <- c
+			}
+			addedConn <- serverConn{}
+		}(current, commId, token)
+	}
+	addConns()
+	// the comm moves back to a server before its own in the list when idle,
+	// or to any server in the list if its own is not there any more
+	failedBack := make(chan serverConn)
+	failingBack := false
+	lastFailback := time.Now()
+	failback := func() {
+		failingBack = true
+		lastFailback = time.Now()
+		go func(servers []remote, current remote) {
+			for _, s := range servers {
+				if s.addr == current.addr {
+					break
+				}
+				c := serverConn{server: s, id: rand.Int63()}
+				var err error
+				c.conn, c.keys, err = getServerConn(s, c.id, nil, connReplace)
+				if err == nil {
+					failedBack <- c
+					return
+				}
+			}
+			failedBack <- serverConn{}
+		}(servers, current)
+	}
+
+	// SIGHUP or a change of the config file reloads the config, keeping the
+	// running one if the new one is bad. The comm stays on its server; if
+	// that is not in the list any more, it fails back to one that is.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	configModTime := modTime(CONFIG_FILEPATH)
+	reloaded := "" // how the last reload went
+	reload := func() {
+		config, err := reloadConfig()
+		if err != nil {
+			reloaded = fmt.Sprintf("config not reloaded: %v", err)
+			return
+		}
+		if config["local"] != globalConfig["local"] {
+			if err := socksServer.Rebind(config["local"]); err != nil {
+				reloaded = fmt.Sprintf("config not reloaded: cannot listen %v", err)
+				return
+			}
+		}
+		var fixed []string
+		for _, key := range restartConfig {
+			if config[key] != globalConfig[key] {
+				fixed = append(fixed, key)
+			}
+		}
+		applyConfig(config)
+		globalConfig = config
+		if i := position(servers, current.addr); i < len(servers) { // its key may have changed
+			current = servers[i]
+		}
+		reloaded = "config reloaded at " + time.Now().Format("15:04:05")
+		if len(fixed) > 0 {
+			reloaded += ", " + strings.Join(fixed, " ") + " take a restart"
+		}
+	}
+
+	// sessionEvent handles data and signals for sessions of a comm or of
+	// one draining
+	sessionEvent := func(ev session.Event) {
+		serv, ok := ev.Session.Obj.(*Serv)
+		if !ok || serv.session == nil { // keepalive session or serv already closed
+			return
+		}
+		switch ev.Type {
+		case session.DATA:
+			serv.writer.Write(ev.Data)
+		case session.SIGNAL:
+			sig := ev.Data[0]
+			if sig == sigClose {
+				serv.Close()
+			} else if sig == sigCloseWrite {
+				serv.writer.CloseWrite()
+				serv.remoteClosed = true
+				serv.closeIfDone()
+			} else if sig == sigConnected {
+				if len(ev.Data) < 2 { // no reply in it, from a broken server
+					serv.socksClient.Reply(socks.REP_SERVER_FAILURE, nil)
+					serv.session.Signal(sigClose)
+					serv.Close()
+					return
+				}
+				bound, _ := net.ResolveTCPAddr("tcp", string(ev.Data[2:]))
+				serv.socksClient.Reply(ev.Data[1], bound)
+			}
+		}
+	}
+
+	// sessions reaped by reason, and the last one
+	reaped := make(map[string]int)
+	lastReaped := ""
+	lastSweep := time.Now()
+	sweep := func(comm *session.Comm) {
+		now := time.Now()
+		for _, sess := range comm.Sessions() {
+			serv, ok := sess.Obj.(*Serv)
+			if !ok || serv.session == nil {
+				continue
+			}
+			reason := policy.reapReason(sess, serv.localClosed || serv.remoteClosed, now)
+			if reason == "" {
+				continue
+			}
+			reaped[reason]++
+			lastReaped = fmt.Sprintf("%s, %s", serv.hostPort, reason)
+			sess.Signal(sigClose)
+			serv.Close()
+		}
+	}
+
 	keepaliveTicker := time.NewTicker(PING_INTERVAL)
 
 	// heartbeat
@@ -145,27 +480,80 @@ loop:
 		// ping
 		case <-keepaliveTicker.C:
 			keepaliveSession.Signal(sigPing)
+			for _, d := range draining {
+				d.keepalive.Signal(sigPing)
+			}
 		// heartbeat
 		case <-heartbeat.C:
-			if time.Now().Sub(comm.LastReadTime) > BAD_CONN_THRESHOLD {
-				comm.UseConn(getServerConn())
-				reconnectTimes += 1
+			if t := modTime(CONFIG_FILEPATH); !t.Equal(configModTime) {
+				configModTime = t
+				reload()
+			}
+			reconnecting := atomic.LoadInt64(&reconnectAttempt)
+			if reconnecting == 0 && time.Now().Sub(comm.LastReadTime()) > BAD_CONN_THRESHOLD {
+				reconnect(false)
+			}
+			// draining comms are closed once done or broken
+			kept := draining[:0]
+			for _, d := range draining {
+				if servs(d.comm) == 0 || d.comm.Conns() == 0 || time.Now().Sub(d.comm.LastReadTime()) > BAD_CONN_THRESHOLD {
+					closeComm(d.comm)
+				} else {
+					kept = append(kept, d)
+				}
+			}
+			draining = kept
+			if reconnecting == 0 {
+				addConns()
+			}
+			if time.Now().Sub(lastSweep) >= SWEEP_INTERVAL {
+				lastSweep = time.Now()
+				sweep(comm)
+				for _, d := range draining {
+					sweep(d.comm)
+				}
+			}
+			if reconnecting == 0 && position(servers, current.addr) > 0 && !failingBack && comm.SessionCount() <= 1 &&
+				time.Now().Sub(lastFailback) > FAILBACK_INTERVAL {
+				failback()
 			}
 
 			box.Clear(box.ColorDefault, box.ColorDefault)
 			printer.Reset()
 			printer.Print("conf %s", CONFIG_FILEPATH)
+			if reloaded != "" {
+				printer.Print("%s", reloaded)
+			}
 			printer.Print("listening %v", globalConfig["local"])
-			printer.Print("connected %v", addr)
-			printer.Print("reconnected %d times", reconnectTimes)
-			printer.Print("%s %s >-< %s", delta(), formatFlow(comm.BytesSent), formatFlow(comm.BytesReceived))
+			if reconnecting > 0 {
+				printer.Print("reconnecting (attempt %d)", reconnecting)
+			} else {
+				if i := position(servers, current.addr); i < len(servers) {
+					printer.Print("connected %v with %d connections, server %d of %d", current.addr, comm.Conns(), i+1, len(servers))
+				} else {
+					printer.Print("connected %v with %d connections, server not in the config any more", current.addr, comm.Conns())
+				}
+			}
+			if len(draining) > 0 {
+				printer.Print("%d comms draining", len(draining))
+			}
+			printer.Print("reconnected %d times, %d packets retransmitted", reconnectTimes, atomic.LoadUint64(&comm.Retransmits))
+			printer.Print("%s %s >-< %s", delta(), formatFlow(atomic.LoadUint64(&comm.BytesSent)), formatFlow(atomic.LoadUint64(&comm.BytesReceived)))
+			printer.Print("data %s >-< %s, compressed %s >-< %s",
+				formatFlow(atomic.LoadUint64(&comm.UncompressedSent)), formatFlow(atomic.LoadUint64(&comm.UncompressedReceived)),
+				formatFlow(atomic.LoadUint64(&comm.CompressedSent)), formatFlow(atomic.LoadUint64(&comm.CompressedReceived)))
+			if lastReaped != "" {
+				printer.Print("reaped %d idle, %d half closed, %d over lifetime, last %s",
+					reaped[reapIdle], reaped[reapHalfClosed], reaped[reapLifetime], lastReaped)
+			}
 			runtime.ReadMemStats(&memStats)
 			printer.Print("%s memory in use", formatFlow(memStats.Alloc))
-			printer.Print("--- %d connections %d sessions ---", clientReader.Count, len(comm.Sessions))
-			for _, sessionId := range ByValue(comm.Sessions, func(a, b reflect.Value) bool {
-				return a.Interface().(*session.Session).StartTime.After(b.Interface().(*session.Session).StartTime)
-			}).Interface().([]int64) {
-				session := comm.Sessions[sessionId]
+			sessions := comm.Sessions()
+			printer.Print("--- %d connections %d sessions ---", atomic.LoadInt32(&clientReader.Count), len(sessions))
+			sort.Slice(sessions, func(i, j int) bool {
+				return sessions[i].StartTime.After(sessions[j].StartTime)
+			})
+			for _, session := range sessions {
 				serv, ok := session.Obj.(*Serv)
 				if !ok {
 					continue
@@ -183,28 +571,38 @@ loop:
 		// new socks client
 		case socksClient := <-socksServer.Clients:
 			serv := &Serv{
-				clientConn: socksClient.Conn,
-				hostPort:   socksClient.HostPort,
+				socksClient: socksClient,
+				clientConn:  socksClient.Conn,
+				hostPort:    socksClient.HostPort,
 			}
 			serv.session = comm.NewSession(-1, []byte(socksClient.HostPort), serv)
-			clientReader.Add(socksClient.Conn, serv)
+			serv.writer = cr.NewWriter(socksClient.Conn, serv.session.Consumed)
+			if _, port, err := net.SplitHostPort(socksClient.HostPort); err == nil && priorityPorts[port] {
+				serv.session.SetPriority(session.PRIORITY_HIGH)
+			}
+			clientReader.Add(socksClient.Conn, serv, serv.session)
 		// client events
 		case ev := <-clientReader.Events:
 			serv := ev.Obj.(*Serv)
 			switch ev.Type {
 			case cr.DATA: // client data
+				if serv.session == nil { // serv already closed
+					continue loop
+				}
 				serv.session.Send(ev.Data)
-			case cr.EOF, cr.ERROR: // client close
+			case cr.EOF: // client closed its write side
 				if serv.session == nil { // serv already closed
 					continue loop
 				}
-				serv.session.Signal(sigClose)
+				serv.session.Signal(sigCloseWrite)
 				serv.localClosed = true
-				if serv.remoteClosed {
-					serv.Close()
-				} else {
-					time.AfterFunc(time.Minute*3, func() { serv.Close() })
+				serv.closeIfDone()
+			case cr.ERROR: // client connection broken
+				if serv.session == nil { // serv already closed
+					continue loop
 				}
+				serv.session.Signal(sigClose)
+				serv.Close()
 			}
 		// server events
 		case ev := <-comm.Events:
@@ -212,33 +610,161 @@ loop:
 			case session.SESSION:
 				log.Fatal("local should not have received this type of event")
 			case session.DATA:
-				serv := ev.Session.Obj.(*Serv)
-				serv.clientConn.Write(ev.Data)
+				sessionEvent(ev)
 			case session.SIGNAL:
-				sig := ev.Data[0]
-				if sig == sigClose {
-					serv := ev.Session.Obj.(*Serv)
-					time.AfterFunc(time.Second*3, func() {
-						serv.clientConn.Close()
-					})
-					serv.remoteClosed = true
-					if serv.localClosed {
-						serv.Close()
-					} else {
-						time.AfterFunc(time.Minute*3, func() { serv.Close() })
-					}
-				} else if sig == sigPing {
+				if ev.Session == keepaliveSession && ev.Data[0] == sigGoAway { // server stopping
+					goneAway = true
+					reconnect(true)
+					continue loop
+				}
+				sessionEvent(ev)
+			case session.ERROR: // the connections are bad, sessions are kept
+				reconnect(false)
+			}
+		// events of draining comms, whose errors show in the heartbeat
+		case ev := <-drainEvents:
+			if ev.Type == session.DATA || ev.Type == session.SIGNAL {
+				sessionEvent(ev)
+			}
+		// connected again
+		case c := <-reconnected:
+			useConn(c)
+			reconnectTimes += 1
+		// a connection added to the comm
+		case c := <-addedConn:
+			if c.missing {
+				if c.id == commId {
+					reconnect(true)
 				}
-			case session.ERROR:
-				log.Fatal("error when communicating with server ", string(ev.Data))
+				continue loop
+			}
+			if c.conn == nil {
+				addingConns = false
+				continue loop
+			}
+			if c.id != commId { // the comm was replaced meanwhile
+				c.conn.Close()
+				continue loop
+			}
+			comm.AddConn(c.conn, c.keys.Send, c.keys.Recv, c.keys.Features)
+		// reload the config
+		case <-signals:
+			configModTime = modTime(CONFIG_FILEPATH)
+			reload()
+		// a server before this one is back
+		case c := <-failedBack:
+			failingBack = false
+			if c.conn == nil {
+				continue loop
+			}
+			if atomic.LoadInt64(&reconnectAttempt) > 0 || comm.SessionCount() > 1 { // not idle any more
+				c.conn.Close()
+				continue loop
 			}
+			useConn(c)
 		}
 	}
 }
 
+// Close closes the serv, dropping data not written to the client yet
 func (self *Serv) Close() {
+	self.clientConn.Close()
+	self.close()
+}
+
+func (self *Serv) close() {
 	self.closeOnce.Do(func() {
+		self.writer.Close() // closes clientConn once the data queued is written
 		self.session.Close()
 		self.session = nil
 	})
 }
+
+// close once both directions are done
+func (self *Serv) closeIfDone() {
+	if self.localClosed && self.remoteClosed {
+		self.close()
+	}
+}
+
+// closeComm closes a comm and the sessions on it
+func closeComm(comm *session.Comm) {
+	for _, sess := range comm.Sessions() {
+		if serv, ok := sess.Obj.(*Serv); ok {
+			serv.Close()
+		}
+	}
+	comm.Close()
+}
+
+// servs returns the number of sessions of clients on a comm
+func servs(comm *session.Comm) int {
+	n := 0
+	for _, sess := range comm.Sessions() {
+		if _, ok := sess.Obj.(*Serv); ok {
+			n++
+		}
+	}
+	return n
+}
+
+// remote is a server local may connect to, with the key for it
+type remote struct {
+	addr string
+	psk  []byte
+}
+
+// remotes returns the servers of the "remote" config, a comma separated list
+// in order of preference. The key of a server is "key@<address>" if there is
+// one, else "key".
+func remotes(config map[string]string) []remote {
+	var ret []remote
+	for _, addr := range strings.Split(config["remote"], ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		key, ok := config["key@"+addr]
+		if !ok {
+			key = config["key"]
+		}
+		ret = append(ret, remote{addr, []byte(key)})
+	}
+	return ret
+}
+
+// position returns the index of the server at addr in servers, or
+// len(servers) if it is not there
+func position(servers []remote, addr string) int {
+	for i, s := range servers {
+		if s.addr == addr {
+			return i
+		}
+	}
+	return len(servers)
+}
+
+// reloadConfig reads the config file again, with the defaults for what it
+// leaves out, and checks it.
+func reloadConfig() (map[string]string, error) {
+	s, err := ioutil.ReadFile(CONFIG_FILEPATH)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(s)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range defaultConfig {
+		if config[key] == "" {
+			config[key] = value
+		}
+	}
+	if len(remotes(config)) == 0 {
+		return nil, fmt.Errorf("no server in remote %q", config["remote"])
+	}
+	if _, err := loadSessionPolicy(func(key string) string { return config[key] }); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
@@ -2,30 +2,68 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	cr "./conn_reader"
+	"./handshake"
 	"./session"
+	"./socks"
+	"./transport"
 )
 
+const (
+	USERS_FILENAME    = ".gotunnel.users"
+	TLS_CERT_FILENAME = ".gotunnel.crt"
+	TLS_KEY_FILENAME  = ".gotunnel.key"
+)
+
+var (
+	DIAL_TIMEOUT = time.Second * 30
+	// sessions get this long to finish when the server stops, unless
+	// "drain_grace" in the config says how many seconds
+	DRAIN_GRACE = time.Second * 30
+)
+
+// settings of the listener, a new one is needed when they change
+var listenerConfig = []string{"listen", "transport", "tls_cert", "tls_key", "ws_path"}
+
 // configuration
 var defaultConfig = map[string]string{
-	"listen": "0.0.0.0:34567",
-	"key":    "foo bar baz foo bar baz ",
+	"listen":    "0.0.0.0:34567",
+	"key":       "foo bar baz foo bar baz ",
+	"transport": "tcp",
 }
 var globalConfig = loadConfig(defaultConfig)
 
+// guards globalConfig once it may be reloaded; the main goroutine, which
+// reloads it, reads it without
+var configLock sync.RWMutex
+
+func getConfig(key string) string {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return globalConfig[key]
+}
+
+var users *Users
+
 func checkConfig(key string) {
 	if value, ok := globalConfig[key]; !ok || value == "" {
 		globalConfig[key] = defaultConfig[key]
@@ -36,6 +74,7 @@ func checkConfig(key string) {
 func init() {
 	checkConfig("listen")
 	checkConfig("key")
+	checkConfig("transport")
 	go func() {
 		http.ListenAndServe("0.0.0.0:55555", nil)
 	}()
@@ -66,7 +105,14 @@ func main() {
 		}
 	}()
 
-	clients := make(map[int64]*Client)
+	clients := newClientTable()
+
+	// users
+	usersPath := globalConfig["users"]
+	if usersPath == "" {
+		usersPath = filepath.Join(filepath.Dir(CONFIG_FILEPATH), USERS_FILENAME)
+	}
+	users = NewUsers(usersPath)
 
 	// control
 	/*
@@ -78,12 +124,13 @@ func main() {
 				os.Stdin.Read(input)
 				switch input[0] {
 				case 'l':
-					for _, client := range clients {
-						fmt.Printf("--- %d connections %d sessions ---\n", client.reader.Count, len(client.comm.Sessions))
-						for _, sessionId := range ByValue(client.comm.Sessions, func(a, b reflect.Value) bool {
-							return a.Interface().(*session.Session).StartTime.After(b.Interface().(*session.Session).StartTime)
-						}).Interface().([]int64) {
-							session := client.comm.Sessions[sessionId]
+					for _, client := range clients.list() {
+						sessions := client.comm.Sessions()
+						fmt.Printf("--- %d connections %d sessions ---\n", atomic.LoadInt32(&client.reader.Count), len(sessions))
+						sort.Slice(sessions, func(i, j int) bool {
+							return sessions[i].StartTime.After(sessions[j].StartTime)
+						})
+						for _, session := range sessions {
 							serv, ok := session.Obj.(*Serv)
 							if !ok {
 								continue
@@ -102,146 +149,526 @@ func main() {
 		}()
 	*/
 
+	revoke := func(revoked []string) {
+		for _, user := range revoked {
+			fmt.Printf("user %s revoked\n", user)
+			for _, client := range clients.list() {
+				if client.user == user {
+					client.revoke()
+				}
+			}
+		}
+	}
+
+	// SIGHUP or a change of the config file reloads the config, SIGTERM
+	// stops the server. The file watcher has a channel of its own, so its
+	// reloads never take the place of a signal.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGTERM)
+	reloads := make(chan struct{}, 1)
+	configModTime := modTime(CONFIG_FILEPATH)
+
 	// heartbeat
 	heartbeat := time.NewTicker(time.Second * 3)
 	go func() {
 		var memStats runtime.MemStats
 		for _ = range heartbeat.C {
+			if t := modTime(CONFIG_FILEPATH); !t.Equal(configModTime) {
+				configModTime = t
+				select {
+				case reloads <- struct{}{}:
+				default:
+				}
+			}
+			revoked, err := users.Reload()
+			if err != nil {
+				fmt.Printf("cannot load users file %s: %v\n", usersPath, err)
+			}
+			revoke(revoked)
 			runtime.ReadMemStats(&memStats)
+			list := clients.list()
 			var connNum, sessionNum int
-			for _, client := range clients {
-				connNum += int(client.reader.Count)
-				sessionNum += len(client.comm.Sessions)
+			for _, client := range list {
+				connNum += int(atomic.LoadInt32(&client.reader.Count))
+				sessionNum += client.comm.SessionCount()
 			}
-			var allocs, reuses int
-			for _, c := range clients {
-				allocs += c.reader.Pool.Allocs
-				reuses += c.reader.Pool.Reuses
+			fmt.Printf("using %s, %d clients, %d conns, %d sessions\n", formatFlow(memStats.Alloc), len(list), connNum, sessionNum)
+			users.Lock()
+			for user, stats := range users.Stats {
+				fmt.Printf("  user %q %d sessions (%d reaped) %s >-< %s\n", user, stats.Sessions, stats.Reaped, formatFlow(stats.BytesSent), formatFlow(stats.BytesReceived))
 			}
-			fmt.Printf("using %s, %d clients, %d conns, %d sessions, buf alloc/reuse %d / %d\n", formatFlow(memStats.Alloc), len(clients), connNum, sessionNum, allocs, reuses)
+			users.Unlock()
 		}
 	}()
 
 	// listen for connections
-	addr, err := net.ResolveTCPAddr("tcp", globalConfig["listen"])
-	if err != nil {
-		log.Fatal("cannot resolve listen address ", err)
+	listen := func(config map[string]string) (net.Listener, error) {
+		trans, err := transport.New(config["transport"], config)
+		if err != nil {
+			return nil, err
+		}
+		if tlsTrans, ok := trans.(*transport.TLS); ok {
+			fingerprint, err := tlsTrans.ServerFingerprint()
+			if err != nil {
+				return nil, err
+			}
+			fmt.Printf("tls certificate fingerprint %s\n", fingerprint)
+		}
+		return trans.Listen(config["listen"])
 	}
-	ln, err := net.ListenTCP("tcp", addr)
+	tlsDefaults(globalConfig)
+	ln, err := listen(globalConfig)
 	if err != nil {
 		log.Fatal("cannot listen ", err)
 	}
+	// accept connections on ln until closed is closed
+	serve := func(ln net.Listener, closed chan struct{}) {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				select {
+				case <-closed:
+					return
+				default:
+				}
+				continue
+			}
+			go func() {
+				// auth, in time, so a silent client does not pin the goroutine
+				conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+				keys, user, err := handshake.Server(conn, users.Key, negotiate)
+				if err != nil { // auth fail
+					conn.Close()
+					return
+				}
+				// read comm id, mode and proof
+				sealed := make([]byte, handshake.SEALED_RESUME_LENGTH)
+				_, err = io.ReadFull(conn, sealed)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				commId, mode, proof, err := handshake.OpenResume(keys, sealed)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				// reject tells local why the connection is not taken
+				reject := func(status uint8) {
+					conn.Write(handshake.SealStatus(keys, status))
+					conn.Close()
+				}
+				clientConn := &ClientConn{conn, keys}
+				client, ok := clients.get(commId)
+				if ok && (client.user != user || !client.resumption.Resume(keys, proof, mode == connReplace)) { // not the owner, or a token replaced meanwhile
+					fmt.Printf("user %s rejected resuming comm %d\n", user, commId)
+					reject(resumeStale)
+					return
+				} else if !ok && mode == connAdd { // comm gone
+					reject(resumeMissing)
+					return
+				}
+				if _, err = conn.Write(handshake.SealStatus(keys, resumeAccepted)); err != nil {
+					conn.Close()
+					return
+				}
+				conn.SetDeadline(time.Time{})
+				if ok && mode == connAdd { // another conn
+					client.pass(client.addConn, clientConn)
+				} else if ok { // change conn
+					client.pass(client.changeConn, clientConn)
+				} else { // handle new comm
+					client := newClient(user, clientConn)
+					if !clients.add(commId, client) { // taken meanwhile, or stopping
+						client.comm.Close()
+						client.reader.Close()
+						return
+					}
+					client.handleConn()
+					clients.remove(commId)
+				}
+			}()
+		}
+	}
+	closed := make(chan struct{})
+	go serve(ln, closed)
+	// rebind moves to a listener for config, leaving the connections
+	// accepted already alone. The new listener is bound before the old one
+	// is closed, unless both are on the same address.
+	rebind := func(config map[string]string) error {
+		same := config["listen"] == globalConfig["listen"]
+		if same {
+			close(closed)
+			ln.Close()
+		}
+		newLn, err := listen(config)
+		if err != nil {
+			if same { // back to the old listener
+				oldLn, err := listen(globalConfig)
+				if err != nil {
+					log.Fatal("cannot listen ", err)
+				}
+				ln, closed = oldLn, make(chan struct{})
+				go serve(ln, closed)
+			}
+			return err
+		}
+		if !same {
+			close(closed)
+			ln.Close()
+		}
+		ln, closed = newLn, make(chan struct{})
+		go serve(ln, closed)
+		return nil
+	}
+
+loop:
 	for {
-		conn, err := ln.AcceptTCP()
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGTERM {
+				break loop
+			}
+		case <-reloads:
+		}
+		// reload, keeping the running config if the new one is bad
+		config, err := reloadConfig()
 		if err != nil {
+			fmt.Printf("config not reloaded: %v\n", err)
 			continue
 		}
-		go func() {
-			var commId int64
-			// auth
-			origin := make([]byte, 64)
-			n, err := io.ReadFull(conn, origin)
-			if err != nil || n != 64 {
-				conn.Close()
-				return
-			}
-			encrypted := make([]byte, 64)
-			n, err = io.ReadFull(conn, encrypted)
-			if err != nil || n != 64 {
-				conn.Close()
-				return
+		if listenerChanged(globalConfig, config) {
+			if err := rebind(config); err != nil {
+				fmt.Printf("config not reloaded: cannot listen %v\n", err)
+				continue
 			}
-			expected, err := encrypt([]byte(globalConfig["key"]), origin)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if bytes.Compare(expected, encrypted) != 0 { // auth fail
-				conn.Write([]byte{0x0})
-				conn.Close()
-				return
-			} else {
-				conn.Write([]byte{0x1})
-			}
-			// read comm id
-			err = binary.Read(conn, binary.LittleEndian, &commId)
-			if err != nil {
-				return
-			}
-			client, ok := clients[commId]
-			if ok { // change conn
-				client.changeConn <- conn
-			} else { // handle new comm
-				client := &Client{
-					changeConn: make(chan *net.TCPConn),
-				}
-				clients[commId] = client
-				client.handleConn(conn)
-				delete(clients, commId)
+			fmt.Printf("listening %s %s\n", config["transport"], config["listen"])
+		}
+		if config["users"] != globalConfig["users"] {
+			fmt.Printf("users file changed, takes a restart\n")
+		}
+		// clients whose key changed with the config are revoked
+		keys := make(map[string][]byte)
+		for _, client := range clients.list() {
+			keys[client.user] = users.Key(client.user)
+		}
+		configLock.Lock()
+		globalConfig = config
+		configLock.Unlock()
+		var revoked []string
+		for user, key := range keys {
+			if !bytes.Equal(users.Key(user), key) {
+				revoked = append(revoked, user)
 			}
-		}()
+		}
+		revoke(revoked)
+		fmt.Printf("config reloaded\n")
+	}
+	close(closed)
+	ln.Close()
+
+	// drain: locals move to another comm while their sessions here finish
+	stopping := clients.stop()
+	fmt.Printf("stopping, draining %d clients\n", len(stopping))
+	for _, client := range stopping {
+		client.goAway()
+	}
+	drained := make(chan struct{})
+	go func() {
+		clients.wait.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainGrace() + time.Second*5):
+	}
+	fmt.Printf("stopped\n")
+}
+
+// reloadConfig reads the config file again, with the defaults for what it
+// leaves out, and checks it.
+func reloadConfig() (map[string]string, error) {
+	s, err := ioutil.ReadFile(CONFIG_FILEPATH)
+	if err != nil {
+		return nil, err
+	}
+	config, err := parseConfig(s)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range defaultConfig {
+		if config[key] == "" {
+			config[key] = value
+		}
+	}
+	tlsDefaults(config)
+	if _, err := transport.New(config["transport"], config); err != nil {
+		return nil, err
+	}
+	switch config["obfuscate"] {
+	case "", "allow", "on", "off":
+	default:
+		return nil, fmt.Errorf("bad obfuscate %q", config["obfuscate"])
+	}
+	switch config["compress"] {
+	case "", "allow", "on", "off": // "on" as local has it, same as "allow"
+	default:
+		return nil, fmt.Errorf("bad compress %q", config["compress"])
+	}
+	if grace := config["drain_grace"]; grace != "" {
+		if n, err := strconv.Atoi(grace); err != nil || n < 0 {
+			return nil, fmt.Errorf("bad drain_grace %q", grace)
+		}
+	}
+	if _, err := loadSessionPolicy(func(key string) string { return config[key] }); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// the certificate and key are next to the config file if not set
+func tlsDefaults(config map[string]string) {
+	if config["tls_cert"] == "" && config["tls_key"] == "" {
+		config["tls_cert"] = filepath.Join(filepath.Dir(CONFIG_FILEPATH), TLS_CERT_FILENAME)
+		config["tls_key"] = filepath.Join(filepath.Dir(CONFIG_FILEPATH), TLS_KEY_FILENAME)
+	}
+}
+
+func listenerChanged(old, config map[string]string) bool {
+	for _, key := range listenerConfig {
+		if old[key] != config[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func drainGrace() time.Duration {
+	if grace, err := strconv.Atoi(getConfig("drain_grace")); err == nil && grace >= 0 {
+		return time.Second * time.Duration(grace)
+	}
+	return DRAIN_GRACE
+}
+
+// grant the protocol version and features a client asked for, as far as
+// the server and the config allow. "obfuscate" is "allow" (the default),
+// "on" to force it or "off". "compress" is "allow" (the default) or "off".
+func negotiate(user string, version uint16, features uint32) (uint16, uint32) {
+	granted, features := session.Negotiate(version, features)
+	if granted == 0 {
+		fmt.Printf("user %s refused, protocol version %d not supported\n", user, version)
+		return 0, 0
+	}
+	switch getConfig("obfuscate") {
+	case "on":
+		features |= session.FEATURE_OBFUSCATION
+	case "off":
+		features &^= session.FEATURE_OBFUSCATION
+	}
+	if getConfig("compress") == "off" {
+		features &^= session.FEATURE_COMPRESSION
+	}
+	return granted, features
+}
+
+// clientTable holds the clients by comm id, for the goroutines accepting
+// connections, the heartbeat and the main goroutine.
+type clientTable struct {
+	lock    sync.Mutex
+	clients map[int64]*Client
+	stopped bool           // no clients are added any more
+	wait    sync.WaitGroup // for the clients added to finish
+}
+
+func newClientTable() *clientTable {
+	return &clientTable{
+		clients: make(map[int64]*Client),
+	}
+}
+
+func (self *clientTable) get(commId int64) (*Client, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	client, ok := self.clients[commId]
+	return client, ok
+}
+
+// add puts the client of a new comm in the table. It fails if the comm id
+// is taken or the table is stopped.
+func (self *clientTable) add(commId int64, client *Client) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if _, ok := self.clients[commId]; ok || self.stopped {
+		return false
+	}
+	self.clients[commId] = client
+	self.wait.Add(1)
+	return true
+}
+
+// remove takes out the client of a comm once it has finished
+func (self *clientTable) remove(commId int64) {
+	self.lock.Lock()
+	delete(self.clients, commId)
+	self.lock.Unlock()
+	self.wait.Done()
+}
+
+// list returns the clients at the time of the call
+func (self *clientTable) list() []*Client {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	clients := make([]*Client, 0, len(self.clients))
+	for _, client := range self.clients {
+		clients = append(clients, client)
 	}
+	return clients
 }
 
+// stop keeps clients from being added, and returns those in the table
+func (self *clientTable) stop() []*Client {
+	self.lock.Lock()
+	self.stopped = true
+	self.lock.Unlock()
+	return self.list()
+}
+
+// Client is the comm of a local. Its comm, sessions and servs are used by
+// the goroutine of handleConn only; others talk to it through channels.
 type Client struct {
-	changeConn chan *net.TCPConn
-	comm       *session.Comm
-	reader     *cr.ConnReader
+	changeConn        chan *ClientConn
+	addConn           chan *ClientConn
+	comm              *session.Comm
+	reader            *cr.ConnReader
+	user              string
+	revoked           chan struct{}
+	revokeOnce        sync.Once
+	goingAway         chan struct{}
+	goAwayOnce        sync.Once
+	done              chan struct{} // closed when handleConn stops handling the comm
+	accountedSent     uint64
+	accountedReceived uint64
+	resumption        *handshake.Resumption
+}
+
+// newClient starts the comm of a local on its first connection
+func newClient(user string, conn *ClientConn) *Client {
+	return &Client{
+		changeConn: make(chan *ClientConn),
+		addConn:    make(chan *ClientConn),
+		comm:       session.NewComm(conn.conn, conn.keys.Send, conn.keys.Recv, conn.keys.Features),
+		reader:     cr.New(),
+		user:       user,
+		revoked:    make(chan struct{}),
+		goingAway:  make(chan struct{}),
+		done:       make(chan struct{}),
+		resumption: handshake.NewResumption(conn.keys),
+	}
+}
+
+// pass hands a connection to the goroutine of the client on ch, or closes
+// it if the client is done
+func (self *Client) pass(ch chan *ClientConn, conn *ClientConn) {
+	select {
+	case ch <- conn:
+	case <-self.done:
+		conn.conn.Close()
+	}
+}
+
+// connection from local with its handshake keys
+type ClientConn struct {
+	conn net.Conn
+	keys *handshake.Keys
 }
 
 type Serv struct {
 	session             *session.Session
 	sendQueue           [][]byte
-	targetConn          io.Writer
-	localClosed         bool
-	remoteClosed        bool
+	targetConn          *net.TCPConn
+	writer              *cr.Writer // writes to targetConn once connected
+	localClosed         bool       // target sent EOF, passed on with sigCloseWrite
+	remoteClosed        bool       // local sent sigCloseWrite
 	closeTargetConnOnce sync.Once
 	hostPort            string
+	reply               byte // dial result as a socks REP_*
 	closeOnce           sync.Once
 }
 
-func (self *Client) handleConn(conn *net.TCPConn) {
-	targetReader := cr.New()
+func (self *Client) handleConn() {
+	targetReader := self.reader
 	defer targetReader.Close()
-	self.reader = targetReader
-	comm := session.NewComm(conn, []byte(globalConfig["key"]))
-	self.comm = comm
-	targetConnEvents := make(chan *Serv)
+	comm := self.comm
+	// the result of dialing the target of a serv, put into the serv by
+	// this goroutine
+	type dialed struct {
+		serv  *Serv
+		conn  *net.TCPConn
+		reply byte
+	}
+	targetConnEvents := make(chan dialed)
 	connectTarget := func(serv *Serv, hostPort string) {
-		defer func() {
-			targetConnEvents <- serv
-		}()
-		addr, err := net.ResolveTCPAddr("tcp", hostPort)
-		if err != nil {
-			return
+		conn, err := net.DialTimeout("tcp", hostPort, DIAL_TIMEOUT)
+		d := dialed{serv: serv, reply: dialReply(err)}
+		if err == nil {
+			d.conn = conn.(*net.TCPConn)
 		}
-		targetConn, err := net.DialTCP("tcp", nil, addr)
-		if err != nil {
-			return
+		select {
+		case targetConnEvents <- d:
+		case <-self.done:
+			if d.conn != nil {
+				d.conn.Close()
+			}
 		}
-		targetReader.Add(targetConn, serv)
-		serv.targetConn = targetConn
-		return
 	}
 
 	heartbeat := time.NewTicker(time.Second * 1)
+	lastSweep := time.Now()
+	var keepalive *session.Session // of local, to tell it the server is stopping
+	goingAway := self.goingAway
+	var drained <-chan time.Time
 
 loop:
 	for {
 		select {
 		// heartbeat
 		case <-heartbeat.C:
-			if time.Now().Sub(comm.LastReadTime) > time.Minute*5 {
+			self.account()
+			if time.Now().Sub(comm.LastReadTime()) > time.Minute*5 {
 				break loop
 			}
+			if drained != nil && !self.busy() {
+				break loop
+			}
+			if time.Now().Sub(lastSweep) >= SWEEP_INTERVAL {
+				lastSweep = time.Now()
+				self.sweep()
+			}
+			// user removed or key changed
+		case <-self.revoked:
+			break loop
+			// server stopping
+		case <-goingAway:
+			goingAway = nil
+			if keepalive != nil {
+				keepalive.Signal(sigGoAway)
+			}
+			drained = time.After(drainGrace())
+		case <-drained:
+			break loop
 			// conn change
 		case conn := <-self.changeConn:
-			comm.UseConn(conn)
+			comm.UseConn(conn.conn, conn.keys.Send, conn.keys.Recv, conn.keys.Features)
+			// another conn
+		case conn := <-self.addConn:
+			comm.AddConn(conn.conn, conn.keys.Send, conn.keys.Recv, conn.keys.Features)
 			// local-side events
 		case ev := <-comm.Events:
 			switch ev.Type {
 			case session.SESSION: // new local session
 				hostPort := string(ev.Data)
 				if hostPort == keepaliveSessionMagic {
+					keepalive = ev.Session
 					continue loop
 				}
 				serv := &Serv{
@@ -250,24 +677,25 @@ loop:
 				}
 				serv.session = ev.Session
 				ev.Session.Obj = serv
+				users.Account(self.user, 1, 0, 0)
 				go connectTarget(serv, hostPort)
 			case session.DATA: // local data
 				serv := ev.Session.Obj.(*Serv)
-				if serv.targetConn == nil {
+				if serv.writer == nil { // bounded by the session window
 					serv.sendQueue = append(serv.sendQueue, ev.Data)
 				} else {
-					serv.targetConn.Write(ev.Data)
+					serv.writer.Write(ev.Data)
 				}
 			case session.SIGNAL: // local session closed
 				sig := ev.Data[0]
 				if sig == sigClose {
+					ev.Session.Obj.(*Serv).Close()
+				} else if sig == sigCloseWrite {
 					serv := ev.Session.Obj.(*Serv)
-					time.AfterFunc(time.Second*3, func() { serv.CloseConn() })
 					serv.remoteClosed = true
-					if serv.localClosed {
-						serv.Close()
-					} else {
-						time.AfterFunc(time.Minute*3, func() { serv.Close() })
+					if serv.writer != nil { // else when connected
+						serv.writer.CloseWrite()
+						serv.closeIfDone()
 					}
 				} else if sig == sigPing { // from keepaliveSession
 					ev.Session.Signal(sigPing)
@@ -276,44 +704,60 @@ loop:
 				break loop
 			}
 			// target connection events
-		case serv := <-targetConnEvents:
+		case d := <-targetConnEvents:
+			serv := d.serv
+			serv.targetConn, serv.reply = d.conn, d.reply
+			if serv.session == nil { // serv already closed
+				serv.CloseConn()
+				continue loop
+			}
 			if serv.targetConn == nil { // fail to connect to target
+				serv.session.SignalData(sigConnected, []byte{serv.reply})
 				serv.session.Signal(sigClose)
-				serv.localClosed = true
-				if serv.remoteClosed {
-					serv.Close()
-				} else {
-					time.AfterFunc(time.Minute*3, func() { serv.Close() })
-				}
+				serv.Close()
 				continue loop
 			}
+			// reply before any target data
+			bound := serv.targetConn.LocalAddr().String()
+			serv.session.SignalData(sigConnected, append([]byte{serv.reply}, bound...))
+			targetReader.Add(serv.targetConn, serv, serv.session)
+			serv.writer = cr.NewWriter(serv.targetConn, serv.session.Consumed)
 			for _, data := range serv.sendQueue {
-				serv.targetConn.Write(data)
+				serv.writer.Write(data)
 			}
 			serv.sendQueue = nil
+			if serv.remoteClosed {
+				serv.writer.CloseWrite()
+			}
 			// target events
 		case ev := <-targetReader.Events:
 			serv := ev.Obj.(*Serv)
 			switch ev.Type {
 			case cr.DATA:
+				if serv.session == nil { // serv already closed
+					continue loop
+				}
 				serv.session.Send(ev.Data)
-			case cr.EOF, cr.ERROR:
+			case cr.EOF:
 				if serv.session == nil { // serv already closed
 					continue loop
 				}
-				serv.session.Signal(sigClose)
+				serv.session.Signal(sigCloseWrite)
 				serv.localClosed = true
-				if serv.remoteClosed {
-					serv.Close()
-				} else {
-					time.AfterFunc(time.Minute*3, func() { serv.Close() })
+				serv.closeIfDone()
+			case cr.ERROR:
+				if serv.session == nil { // serv already closed
+					continue loop
 				}
+				serv.session.Signal(sigClose)
+				serv.Close()
 			}
 		}
 	}
 
 	// clear
-	for _, session := range comm.Sessions {
+	close(self.done)
+	for _, session := range comm.Sessions() {
 		serv, ok := session.Obj.(*Serv)
 		if ok {
 			serv.CloseConn()
@@ -323,11 +767,70 @@ loop:
 		}
 	}
 	comm.Close()
+	self.account()
 }
 
+// add traffic since the last call to the user's stats
+func (self *Client) account() {
+	sent, received := atomic.LoadUint64(&self.comm.BytesSent), atomic.LoadUint64(&self.comm.BytesReceived)
+	users.Account(self.user, 0, sent-self.accountedSent, received-self.accountedReceived)
+	self.accountedSent, self.accountedReceived = sent, received
+}
+
+func (self *Client) revoke() {
+	self.revokeOnce.Do(func() {
+		close(self.revoked)
+	})
+}
+
+func (self *Client) goAway() {
+	self.goAwayOnce.Do(func() {
+		close(self.goingAway)
+	})
+}
+
+// sweep reaps the sessions to targets that are stale by the session policy
+// of the config. Local is told to close them too, in case it still has them.
+func (self *Client) sweep() {
+	policy, _ := loadSessionPolicy(getConfig)
+	now := time.Now()
+	for _, sess := range self.comm.Sessions() {
+		serv, ok := sess.Obj.(*Serv)
+		if !ok {
+			continue
+		}
+		reason := policy.reapReason(sess, serv.localClosed || serv.remoteClosed, now)
+		if reason == "" {
+			continue
+		}
+		fmt.Printf("user %s session to %s reaped, %s\n", self.user, serv.hostPort, reason)
+		users.Reaped(self.user)
+		sess.Signal(sigClose)
+		serv.Close()
+	}
+}
+
+// busy tells if the comm still has sessions to targets
+func (self *Client) busy() bool {
+	for _, session := range self.comm.Sessions() {
+		if _, ok := session.Obj.(*Serv); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Close closes the serv, dropping data not written to the target yet
 func (self *Serv) Close() {
 	self.CloseConn()
+	self.close()
+}
+
+func (self *Serv) close() {
 	self.closeOnce.Do(func() {
+		if self.writer != nil { // closes targetConn once the data queued is written
+			self.writer.Close()
+		}
 		self.session.Close()
 		self.session = nil
 	})
@@ -336,7 +839,35 @@ func (self *Serv) Close() {
 func (self *Serv) CloseConn() {
 	if self.targetConn != nil {
 		self.closeTargetConnOnce.Do(func() {
-			self.targetConn.(*net.TCPConn).Close()
+			self.targetConn.Close()
 		})
 	}
 }
+
+// dialReply tells the socks reply for the result of dialing a target
+func dialReply(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return socks.REP_SUCCEED
+	case errors.As(err, &dnsErr):
+		return socks.REP_HOST_UNREACHABLE
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks.REP_CONNECTION_REFUSED
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks.REP_NETWORK_UNREACHABLE
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return socks.REP_HOST_UNREACHABLE
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks.REP_TTL_EXPIRED
+	}
+	return socks.REP_SERVER_FAILURE
+}
+
+// close once both directions are done
+func (self *Serv) closeIfDone() {
+	if self.localClosed && self.remoteClosed {
+		self.close()
+	}
+}
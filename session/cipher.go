@@ -0,0 +1,81 @@
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+const (
+	TAG_LENGTH = 16
+)
+
+// frameCipher seals the frames of one direction of a connection with
+// AES-GCM. The nonce is a counter of frames sealed under the current key,
+// so both sides must seal and open every frame in the same order. The
+// counter only moves on a frame that opens; the connection is a stream,
+// which loses and reorders nothing, so a frame that does not open was
+// tampered with, and its link is closed.
+type frameCipher struct {
+	key     []byte
+	epoch   uint32 // number of rekeys since the connection keys
+	aead    cipher.AEAD
+	counter uint64
+}
+
+func newFrameCipher(key []byte) (*frameCipher, error) {
+	subkey, err := hkdf.Key(sha256.New, key, nil, "gotunnel frame", 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &frameCipher{
+		key:  key,
+		aead: aead,
+	}, nil
+}
+
+// next returns the cipher of the next key epoch.
+func (self *frameCipher) next() (*frameCipher, error) {
+	key, err := hkdf.Key(sha256.New, self.key, nil, "gotunnel rekey", 32)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := newFrameCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	ret.epoch = self.epoch + 1
+	return ret, nil
+}
+
+func (self *frameCipher) nonce() []byte {
+	nonce := make([]byte, self.aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce, self.counter)
+	return nonce
+}
+
+// seal appends the sealed plaintext to dst.
+func (self *frameCipher) seal(dst, plaintext []byte) []byte {
+	ret := self.aead.Seal(dst, self.nonce(), plaintext, nil)
+	self.counter++
+	return ret
+}
+
+func (self *frameCipher) open(sealed []byte) ([]byte, error) {
+	ret, err := self.aead.Open(sealed[:0], self.nonce(), sealed, nil)
+	if err != nil {
+		return nil, err
+	}
+	self.counter++
+	return ret, nil
+}
@@ -3,14 +3,14 @@ package session
 import (
 	"../utils"
 	"bufio"
-	"bytes"
-	"crypto/aes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,6 +25,28 @@ const (
 	ERROR
 
 	MAX_DATA_LENGTH = 1<<16 - 1
+	HEADER_LENGTH   = 4 + 8 + 1 + 2 // serial, session id, type, padding length
+)
+
+var (
+	// the sending side moves to a new key after this many bytes or this
+	// long under one key
+	REKEY_BYTES    = uint64(1 << 30)
+	REKEY_INTERVAL = time.Minute * 10
+
+	// obfuscation: frames get up to MAX_PADDING bytes of padding, a cover
+	// packet is sent every COVER_INTERVAL on average, and acks are sent
+	// every ACK_INTERVAL give or take half of it
+	MAX_PADDING    = 1024
+	COVER_INTERVAL = time.Second * 2
+	ACK_INTERVAL   = time.Millisecond * 500
+
+	// packets of an unknown session are kept this long for its connect
+	// packet to come on another link
+	ORPHAN_TIMEOUT = time.Minute
+
+	// acks carry at most this many ranges of serials received out of order
+	MAX_SACK_RANGES = 16
 )
 
 type Event struct {
@@ -34,229 +56,602 @@ type Event struct {
 }
 
 type Packet struct {
-	serial uint32
-	data   []byte
-	next   *Packet
+	serial     uint32
+	sessionId  int64
+	t          uint8
+	data       []byte // plaintext payload, sealed when written
+	compressed bool
+	more       bool // not the last fragment of data
+	next       *Packet
+	sent       int64 // unix nano time of the last write, 0 while queued
+	retries    int
+	sacked     bool // received by the other side out of order
 }
 
+// Comm is used by the goroutine owning it, its links' readers and senders
+// and its acker. Locks are taken in the order recvLock, sessionsLock, a
+// session's packetsLock, then the scheduler's.
 type Comm struct {
-	IsClosed      bool
-	conn          *net.TCPConn       // tcp connection to other side
-	Sessions      map[int64]*Session // map session id to *Session
-	ackQueue      <-chan []byte      // ack packet queue
-	ackQueueIn    chan []byte        // ack packet queue
-	eventsIn      chan Event
-	Events        <-chan Event // events channel
-	key           []byte       // encryption key
+	IsClosed     bool
+	links        []*link    // connections to other side
+	linksLock    sync.Mutex // guards links
+	linksWait    sync.WaitGroup
+	sessions     map[int64]*Session // map session id to *Session
+	sessionsLock sync.Mutex         // guards sessions
+	ackQueue     <-chan *Packet     // ack packet queue
+	ackQueueIn   chan *Packet       // ack packet queue
+	eventsIn     chan Event
+	Events       <-chan Event // events channel
+	features     uint32       // features of the latest connection, accessed atomically
+	recvLock     sync.Mutex   // packets from all links are handled one at a time
+	orphans      map[int64]*orphan
+	rto          *rtoEstimator // guarded by recvLock
+	// counters, accessed atomically
+	Retransmits   uint64
 	BytesSent     uint64
 	BytesReceived uint64
+	// data of sessions before compression and as sent
+	UncompressedSent     uint64
+	CompressedSent       uint64
+	UncompressedReceived uint64
+	CompressedReceived   uint64
+	stopAck              chan struct{} // chan to stop ack
+	stoppedAck           chan struct{}
+	lastRead             int64      // unix nano time of the last packet read, accessed atomically
+	sched                *scheduler // packets of sessions to send
+}
+
+// link is one connection of a Comm. Every link has its own keys, reader and
+// sender; the senders take packets from the shared queues as fast as their
+// connections allow.
+type link struct {
+	comm          *Comm
+	conn          net.Conn
+	features      uint32
+	sendCipher    *frameCipher
+	recvCipher    *frameCipher
+	keyBytesSent  uint64    // bytes sent with the current send key
+	keyTime       time.Time // when the current send key was taken
+	closeOnce     sync.Once
 	stopSender    chan struct{} // chan to stop sender
-	stopAck       chan struct{} // chan to stop ack
 	stoppedReader chan struct{}
 	stoppedSender chan struct{}
-	stoppedAck    chan struct{}
-	LastReadTime  time.Time
-	sendQueue     <-chan *Packet
-	sendQueueIn   chan *Packet
 }
 
-func NewComm(conn *net.TCPConn, key []byte) *Comm {
-	_, err := aes.NewCipher(key)
-	if err != nil {
-		log.Fatal(err)
-	}
+// packets of a session not known yet. With several links the connect packet
+// of a session may come after its first data.
+type orphan struct {
+	packets []*Packet
+	time    time.Time
+}
+
+// NewComm starts a Comm on conn. sendKey and recvKey are the per-connection
+// keys for each direction, features are the negotiated FEATURE_* bits.
+func NewComm(conn net.Conn, sendKey, recvKey []byte, features uint32) *Comm {
 	c := &Comm{
+		features:   features,
+		sessions:   make(map[int64]*Session),
+		ackQueueIn: make(chan *Packet),
+		eventsIn:   make(chan Event),
+		orphans:    make(map[int64]*orphan),
+		rto:        newRTOEstimator(),
+		stopAck:    make(chan struct{}),
+		stoppedAck: make(chan struct{}),
+		lastRead:   time.Now().UnixNano(),
+		sched:      newScheduler(),
+	}
+	c.Events = utils.MakeChan(c.eventsIn).(<-chan Event)
+	c.ackQueue = utils.MakeChan(c.ackQueueIn).(<-chan *Packet)
+
+	c.AddConn(conn, sendKey, recvKey, features)
+	go c.startAck()
+
+	return c
+}
+
+// Negotiate returns the protocol version and features to use with a side
+// that offers version and asks for features: the highest version both
+// speak, 0 if there is none, and the features this side knows.
+func Negotiate(version uint16, features uint32) (uint16, uint32) {
+	if version > PROTOCOL_VERSION {
+		version = PROTOCOL_VERSION
+	}
+	if version < MIN_PROTOCOL_VERSION {
+		return 0, 0
+	}
+	return version, features & FEATURES
+}
+
+func (self *Comm) newLink(conn net.Conn, sendKey, recvKey []byte, features uint32) *link {
+	l := &link{
+		comm:          self,
 		conn:          conn,
-		Sessions:      make(map[int64]*Session),
-		ackQueueIn:    make(chan []byte),
-		eventsIn:      make(chan Event),
-		key:           key,
+		features:      features,
 		stopSender:    make(chan struct{}),
-		stopAck:       make(chan struct{}),
 		stoppedReader: make(chan struct{}),
 		stoppedSender: make(chan struct{}),
-		stoppedAck:    make(chan struct{}),
-		LastReadTime:  time.Now(),
-		sendQueueIn:   make(chan *Packet),
 	}
-	c.Events = utils.MakeChan(c.eventsIn).(<-chan Event)
-	c.ackQueue = utils.MakeChan(c.ackQueueIn).(<-chan []byte)
-	c.sendQueue = utils.MakeChan(c.sendQueueIn).(<-chan *Packet)
+	var err error
+	l.sendCipher, err = newFrameCipher(sendKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l.recvCipher, err = newFrameCipher(recvKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l.keyTime = time.Now()
+	return l
+}
 
-	go c.startReader()
-	go c.startSender()
-	go c.startAck()
+func (self *Comm) startLink(l *link) {
+	self.linksLock.Lock()
+	self.links = append(self.links, l)
+	self.linksLock.Unlock()
+	self.linksWait.Add(1)
+	go l.startReader()
+	go l.startSender()
+}
 
-	return c
+// AddConn adds a connection to the Comm, with that connection's keys and
+// features. Packets are spread over all connections.
+func (self *Comm) AddConn(conn net.Conn, sendKey, recvKey []byte, features uint32) {
+	atomic.StoreUint32(&self.features, features)
+	self.startLink(self.newLink(conn, sendKey, recvKey, features))
+}
+
+// Sessions returns the sessions of the Comm at the time of the call.
+func (self *Comm) Sessions() []*Session {
+	self.sessionsLock.Lock()
+	defer self.sessionsLock.Unlock()
+	sessions := make([]*Session, 0, len(self.sessions))
+	for _, session := range self.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// SessionCount returns the number of sessions of the Comm.
+func (self *Comm) SessionCount() int {
+	self.sessionsLock.Lock()
+	defer self.sessionsLock.Unlock()
+	return len(self.sessions)
+}
+
+// LastReadTime returns when a packet was last read on any connection.
+func (self *Comm) LastReadTime() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastRead))
+}
+
+// Conns returns the number of connections of the Comm.
+func (self *Comm) Conns() int {
+	self.linksLock.Lock()
+	defer self.linksLock.Unlock()
+	return len(self.links)
 }
 
-func (self *Comm) UseConn(conn *net.TCPConn) {
+// take all links out of the Comm and stop them
+func (self *Comm) stopLinks() {
+	self.linksLock.Lock()
+	links := self.links
+	self.links = nil
+	self.linksLock.Unlock()
+	for _, l := range links {
+		l.close()
+		<-l.stoppedReader
+	}
+}
+
+// called by a link whose reader stopped. Packets its sender may have lost
+// are sent again on the other links, unless the Comm took the link out.
+func (self *Comm) dropLink(l *link) {
+	found := false
+	self.linksLock.Lock()
+	for i, o := range self.links {
+		if o == l {
+			self.links = append(self.links[:i], self.links[i+1:]...)
+			found = true
+			break
+		}
+	}
+	self.linksLock.Unlock()
+	l.close()
+	<-l.stoppedSender
+	if found {
+		for _, session := range self.Sessions() {
+			for _, packet := range session.unacked() {
+				session.queue(packet)
+			}
+		}
+	}
+}
+
+// UseConn resumes the Comm on a new connection with that connection's keys
+// and features, in place of all its connections.
+func (self *Comm) UseConn(conn net.Conn, sendKey, recvKey []byte, features uint32) {
 	// stop
-	self.conn.Close()
-	<-self.stoppedReader
-	close(self.stopSender)
-	<-self.stoppedSender
+	self.stopLinks()
 	close(self.stopAck)
 	<-self.stoppedAck
 	// resent
-	self.conn = conn
-	for _, session := range self.Sessions {
-		for t, h := session.packets.tail, session.packets.head; t != h; t = t.next {
-			self.write(t.data)
-			self.BytesSent += uint64(len(t.data))
+	atomic.StoreUint32(&self.features, features)
+	l := self.newLink(conn, sendKey, recvKey, features)
+	for _, session := range self.Sessions() {
+		for _, packet := range session.unacked() {
+			l.write(packet)
 		}
 	}
 	// restart
-	self.LastReadTime = time.Now()
-	self.stopSender = make(chan struct{})
+	atomic.StoreInt64(&self.lastRead, time.Now().UnixNano())
 	self.stopAck = make(chan struct{})
-	self.stoppedReader = make(chan struct{})
-	self.stoppedSender = make(chan struct{})
 	self.stoppedAck = make(chan struct{})
-	go self.startReader()
-	go self.startSender()
+	self.startLink(l)
 	go self.startAck()
 }
 
-func (self *Comm) write(data []byte) {
-	l := len(data)
-	if l > MAX_DATA_LENGTH {
-		log.Fatal("data too long")
+func (self *link) close() {
+	self.closeOnce.Do(func() {
+		self.conn.Close()
+		close(self.stopSender)
+	})
+}
+
+// rekey tells the other side to move to the next key, then moves the send
+// side. Everything written after the rekey packet, retransmissions included,
+// is sealed with the new key; the other side moves its receive key when it
+// reads the rekey packet, so no frame is ever opened with the wrong key.
+func (self *link) rekey() {
+	next, err := self.sendCipher.next()
+	if err != nil {
+		log.Fatal(err)
 	}
-	binary.Write(self.conn, binary.LittleEndian, uint16(l))
+	self.write(&Packet{serial: next.epoch, t: typeRekey})
+	self.sendCipher = next
+	self.keyBytesSent = 0
+	self.keyTime = time.Now()
+}
+
+func (self *Comm) obfuscated() bool {
+	return atomic.LoadUint32(&self.features)&FEATURE_OBFUSCATION != 0
+}
+
+func (self *Comm) compressing() bool {
+	return atomic.LoadUint32(&self.features)&FEATURE_COMPRESSION != 0
+}
+
+func (self *Comm) prioritizing() bool {
+	return atomic.LoadUint32(&self.features)&FEATURE_PRIORITY != 0
+}
+
+func (self *link) obfuscated() bool {
+	return self.features&FEATURE_OBFUSCATION != 0
+}
+
+// encode returns the frame of a packet: the sealed length of the body,
+// followed by the sealed body, which is the packet header, payload and
+// padding. Nothing but ciphertext goes over the wire. Packets fit in
+// MAX_DATA_LENGTH, as Session.Send splits long data.
+func (self *link) encode(packet *Packet) []byte {
+	l := HEADER_LENGTH + len(packet.data)
+	padding := 0
+	if self.obfuscated() {
+		padding = rand.Intn(MAX_PADDING + 1)
+		if l+padding > MAX_DATA_LENGTH {
+			padding = MAX_DATA_LENGTH - l
+		}
+		l += padding
+	}
+	body := make([]byte, HEADER_LENGTH, l)
+	binary.LittleEndian.PutUint32(body, packet.serial)
+	binary.LittleEndian.PutUint64(body[4:], uint64(packet.sessionId))
+	body[12] = packet.t
+	if packet.compressed {
+		body[12] |= flagCompressed
+	}
+	if packet.more {
+		body[12] |= flagMore
+	}
+	binary.LittleEndian.PutUint16(body[13:], uint16(padding))
+	body = append(body, packet.data...)
+	body = body[:l]
+	lenBuf := make([]byte, 2)
+	binary.LittleEndian.PutUint16(lenBuf, uint16(l))
+	frame := make([]byte, 0, 2+TAG_LENGTH+l+TAG_LENGTH)
+	frame = self.sendCipher.seal(frame, lenBuf)
+	return self.sendCipher.seal(frame, body)
+}
+
+func (self *link) write(packet *Packet) {
+	data := self.encode(packet)
+	atomic.StoreInt64(&packet.sent, time.Now().UnixNano())
 	self.conn.Write(data)
+	atomic.AddUint64(&self.comm.BytesSent, uint64(len(data)))
+	self.keyBytesSent += uint64(len(data))
 }
 
-func (self *Comm) startSender() {
+func (self *link) startSender() {
+	defer close(self.stoppedSender)
+	var cover <-chan time.Time
+	if self.obfuscated() {
+		cover = time.After(jitter(COVER_INTERVAL, COVER_INTERVAL))
+	}
 	for {
 		select {
-		case data := <-self.ackQueue:
-			self.write(data)
-			self.BytesSent += uint64(len(data))
-		case packet := <-self.sendQueue:
-			self.write(packet.data)
-			self.BytesSent += uint64(len(packet.data))
+		case packet := <-self.comm.ackQueue:
+			self.write(packet)
+		case <-self.comm.sched.ready:
+			if packet := self.comm.sched.pop(); packet != nil {
+				self.write(packet)
+			}
+		case <-cover:
+			self.write(&Packet{t: typeCover, data: make([]byte, rand.Intn(MAX_PADDING+1))})
+			cover = time.After(jitter(COVER_INTERVAL, COVER_INTERVAL))
 		case <-self.stopSender:
-			close(self.stoppedSender)
 			return
 		}
+		if self.keyBytesSent >= REKEY_BYTES || time.Now().Sub(self.keyTime) >= REKEY_INTERVAL {
+			self.rekey()
+		}
 	}
 }
 
-func (self *Comm) startReader() {
-	defer close(self.stoppedReader)
-	var id int64
-	var t uint8
-	var serial uint32
+func (self *link) startReader() {
+	defer func() {
+		self.comm.dropLink(self)
+		close(self.stoppedReader)
+		self.comm.linksWait.Done()
+	}()
+	comm := self.comm
 	var err error
-	var packetLen uint16
-	discardBuffer := make([]byte, MAX_DATA_LENGTH+1)
-	var n int
 	connReader := bufio.NewReaderSize(self.conn, 65536)
-loop:
+	lenBuf := make([]byte, 2+TAG_LENGTH)
 	for {
-		// read packet
-		if packetLen > 0 {
-			n, _ = io.ReadFull(connReader, discardBuffer[:packetLen])
-			if uint16(n) != packetLen {
-				return
-			}
-		}
-		err = binary.Read(connReader, binary.LittleEndian, &packetLen)
+		// read length
+		_, err = io.ReadFull(connReader, lenBuf)
 		if err != nil {
 			return
 		}
-		// read header
-		err = binary.Read(connReader, binary.LittleEndian, &serial)
+		l, err := self.recvCipher.open(lenBuf)
 		if err != nil {
+			comm.emit(Event{Type: ERROR, Data: []byte("packet authentication failed")})
 			return
 		}
-		self.BytesReceived += 4
-		packetLen -= 4
-		err = binary.Read(connReader, binary.LittleEndian, &id)
-		if err != nil {
+		packetLen := binary.LittleEndian.Uint16(l)
+		if packetLen < HEADER_LENGTH {
+			comm.emit(Event{Type: ERROR, Data: []byte("packet too short")})
 			return
 		}
-		self.BytesReceived += 8
-		packetLen -= 8
-		err = binary.Read(connReader, binary.LittleEndian, &t)
+		// read body
+		body := make([]byte, int(packetLen)+TAG_LENGTH)
+		_, err = io.ReadFull(connReader, body)
 		if err != nil {
 			return
 		}
-		self.BytesReceived += 1
-		packetLen -= 1
-		self.LastReadTime = time.Now() // update last read time
-		// get session
-		session, ok := self.Sessions[id]
-		if !ok && t == typeConnect { // new session
-			session = self.NewSession(id, nil, nil)
-		} else if !ok {
-			continue loop
+		body, err = self.recvCipher.open(body)
+		if err != nil {
+			comm.emit(Event{Type: ERROR, Data: []byte("packet authentication failed")})
+			return
 		}
-		// is ack packet
-		if t == typeAck {
-			session.maxAckSerial = serial
-			// clear packet buffer
-			for p, h := session.packets.tail, session.packets.head; p != h && p.serial <= serial; {
-				session.packets.De()
-				p = session.packets.tail
-			}
-			continue loop
+		atomic.AddUint64(&comm.BytesReceived, uint64(len(lenBuf)+int(packetLen)+TAG_LENGTH))
+		atomic.StoreInt64(&comm.lastRead, time.Now().UnixNano()) // update last read time
+		// read header
+		packet := &Packet{
+			serial:     binary.LittleEndian.Uint32(body),
+			sessionId:  int64(binary.LittleEndian.Uint64(body[4:])),
+			t:          body[12] &^ (flagCompressed | flagMore),
+			compressed: body[12]&flagCompressed != 0,
+			more:       body[12]&flagMore != 0,
 		}
-		// check serial
-		if serial <= session.maxReceivedSerial { // duplicated packet
-			continue loop
+		if (packet.compressed || packet.more) && packet.t != typeData {
+			comm.emit(Event{Type: ERROR, Data: []byte("flags on packet not data")})
+			return
 		}
-		session.maxReceivedSerial = serial
-		// read data
-		data := make([]byte, packetLen)
-		n, _ = io.ReadFull(connReader, data)
-		if uint16(n) != packetLen {
+		padding := int(binary.LittleEndian.Uint16(body[13:]))
+		if padding > len(body)-HEADER_LENGTH {
+			comm.emit(Event{Type: ERROR, Data: []byte("bad padding length")})
 			return
 		}
-		self.BytesReceived += uint64(packetLen)
-		packetLen = 0
-		// decrypt
-		block, _ := aes.NewCipher(self.key)
-		for i, size := aes.BlockSize, len(data); i < size; i += aes.BlockSize {
-			block.Decrypt(data[i-aes.BlockSize:i], data[i-aes.BlockSize:i])
+		packet.data = body[HEADER_LENGTH : len(body)-padding]
+		switch packet.t {
+		case typeCover:
+		case typeRekey: // move to the next receive key
+			next, err := self.recvCipher.next()
+			if err != nil {
+				log.Fatal(err)
+			}
+			if packet.serial != next.epoch {
+				comm.emit(Event{Type: ERROR, Data: []byte("bad rekey packet")})
+				return
+			}
+			self.recvCipher = next
+		case typeConnect, typeData, typeSignal, typeAck, typeWindow, typePriority:
+			if !comm.receive(packet) {
+				return
+			}
+		default:
+			comm.emit(Event{Type: ERROR, Data: []byte(fmt.Sprintf("unrecognized packet type %d", packet.t))})
+			return
 		}
+	}
+}
 
-		switch t {
+// receive handles a packet from any link. Packets of a session are passed
+// on in serial order; ones that come early wait for those before them.
+func (self *Comm) receive(packet *Packet) bool {
+	self.recvLock.Lock()
+	defer self.recvLock.Unlock()
+	// get session
+	self.sessionsLock.Lock()
+	session, ok := self.sessions[packet.sessionId]
+	self.sessionsLock.Unlock()
+	if !ok && packet.t == typeConnect { // new session
+		session = self.NewSession(packet.sessionId, nil, nil)
+		if o, ok := self.orphans[packet.sessionId]; ok {
+			for _, p := range o.packets {
+				session.pending[p.serial] = p
+			}
+			delete(self.orphans, packet.sessionId)
+		}
+	} else if !ok {
+		if packet.t == typeData || packet.t == typeSignal || packet.t == typePriority {
+			o, ok := self.orphans[packet.sessionId]
+			if !ok {
+				o = &orphan{time: time.Now()}
+				self.orphans[packet.sessionId] = o
+			}
+			o.packets = append(o.packets, packet)
+		}
+		return true
+	}
+	switch packet.t {
+	case typeAck:
+		if len(packet.data)%8 != 0 {
+			self.emit(Event{Type: ERROR, Data: []byte("bad ack")})
+			return false
+		}
+		atomic.StoreUint32(&session.maxAckSerial, packet.serial)
+		// clear packet buffer, timing the newest packet not sent again
+		var rtt time.Duration
+		now := time.Now().UnixNano()
+		session.packetsLock.Lock()
+		for p, h := session.packets.tail, session.packets.head; p != h && p.serial <= packet.serial; {
+			if sent := atomic.LoadInt64(&p.sent); p.retries == 0 && sent != 0 {
+				rtt = time.Duration(now - sent)
+			}
+			session.packets.De()
+			p = session.packets.tail
+		}
+		// mark packets the other side has out of order
+		for i := 0; i < len(packet.data); i += 8 {
+			first := binary.LittleEndian.Uint32(packet.data[i:])
+			last := binary.LittleEndian.Uint32(packet.data[i+4:])
+			for p, h := session.packets.tail, session.packets.head; p != h && p.serial <= last; p = p.next {
+				if p.serial >= first {
+					p.sacked = true
+				}
+			}
+		}
+		session.packetsLock.Unlock()
+		if rtt > 0 {
+			self.rto.sample(rtt)
+		}
+		return true
+	case typeWindow:
+		if len(packet.data) != 8 {
+			self.emit(Event{Type: ERROR, Data: []byte("bad window update")})
+			return false
+		}
+		session.grant(binary.LittleEndian.Uint64(packet.data))
+		return true
+	}
+	// check serial
+	if packet.serial <= session.maxReceivedSerial { // duplicated packet
+		session.ackNeeded = true // the ack may have been lost
+		return true
+	}
+	session.pending[packet.serial] = packet
+	for {
+		packet, ok := session.pending[session.maxReceivedSerial+1]
+		if !ok {
+			break
+		}
+		delete(session.pending, packet.serial)
+		session.maxReceivedSerial = packet.serial
+		session.active()
+		switch packet.t {
 		case typeConnect:
-			self.emit(Event{Type: SESSION, Session: session, Data: data})
+			self.emit(Event{Type: SESSION, Session: session, Data: packet.data})
 		case typeData:
+			data := packet.data
+			if packet.compressed {
+				var err error
+				data, err = session.decompressor.decompress(data)
+				if err != nil {
+					self.emit(Event{Type: ERROR, Data: []byte(err.Error())})
+					return false
+				}
+			}
+			atomic.AddUint64(&self.CompressedReceived, uint64(len(packet.data)))
+			atomic.AddUint64(&self.UncompressedReceived, uint64(len(data)))
+			// join fragments
+			if packet.more || session.fragments != nil {
+				if len(session.fragments)+len(data) > MAX_MESSAGE_LENGTH {
+					self.emit(Event{Type: ERROR, Data: []byte("data too long")})
+					return false
+				}
+				session.fragments = append(session.fragments, data...)
+				if packet.more {
+					continue
+				}
+				data, session.fragments = session.fragments, nil
+			}
 			self.emit(Event{Type: DATA, Session: session, Data: data})
 		case typeSignal:
-			self.emit(Event{Type: SIGNAL, Session: session, Data: data})
-		default:
-			self.emit(Event{Type: ERROR, Data: []byte(fmt.Sprintf("unrecognized packet type %s", t))})
-			return
+			self.emit(Event{Type: SIGNAL, Session: session, Data: packet.data})
+		case typePriority:
+			if len(packet.data) != 1 {
+				self.emit(Event{Type: ERROR, Data: []byte("bad priority")})
+				return false
+			}
+			atomic.StoreUint32(&session.priority, uint32(packet.data[0]))
 		}
 	}
+	return true
 }
 
 func (self *Comm) emit(ev Event) {
 	self.eventsIn <- ev
 }
 
+// startAck sends acks and window updates, and retransmits packets not
+// acked in time.
 func (self *Comm) startAck() {
 	lastAck := make(map[int64]uint32)
-	ticker := time.NewTicker(time.Millisecond * 500)
+	lastWindow := make(map[int64]uint64)
+	spread := time.Duration(0)
+	if self.obfuscated() {
+		spread = ACK_INTERVAL / 2
+	}
+	retransmit := time.NewTicker(MIN_RTO / 4)
+	defer retransmit.Stop()
+	ack := time.After(jitter(ACK_INTERVAL, spread))
 	for {
 		select {
-		case <-ticker.C:
-			for sessionId, session := range self.Sessions {
+		case <-retransmit.C:
+			self.retransmit()
+		case <-ack:
+			ack = time.After(jitter(ACK_INTERVAL, spread))
+			sessions := self.Sessions()
+			self.recvLock.Lock()
+			for _, session := range sessions {
 				ackSerial := session.maxReceivedSerial
-				if ackSerial == lastAck[sessionId] {
+				if ackSerial == lastAck[session.Id] && !session.ackNeeded && len(session.pending) == 0 {
 					continue
 				}
-				buf := new(bytes.Buffer)
-				binary.Write(buf, binary.LittleEndian, ackSerial)
-				binary.Write(buf, binary.LittleEndian, sessionId)
-				binary.Write(buf, binary.LittleEndian, typeAck)
-				self.ackQueueIn <- buf.Bytes()
-				lastAck[sessionId] = ackSerial
+				self.ackQueueIn <- &Packet{
+					serial:    ackSerial,
+					sessionId: session.Id,
+					t:         typeAck,
+					data:      session.sackRanges(),
+				}
+				lastAck[session.Id] = ackSerial
+				session.ackNeeded = false
+			}
+			// drop packets of sessions that never came
+			for id, o := range self.orphans {
+				if time.Now().Sub(o.time) > ORPHAN_TIMEOUT {
+					delete(self.orphans, id)
+				}
+			}
+			self.recvLock.Unlock()
+			// repeat window updates, in case one was lost with a connection
+			for _, session := range sessions {
+				consumed := atomic.LoadUint64(&session.consumed)
+				if consumed == lastWindow[session.Id] {
+					continue
+				}
+				self.ackQueueIn <- session.windowPacket(consumed)
+				lastWindow[session.Id] = consumed
 			}
 		case <-self.stopAck:
 			close(self.stoppedAck)
@@ -265,16 +660,49 @@ func (self *Comm) startAck() {
 	}
 }
 
+// retransmit queues again the packets not acked within the retransmission
+// timeout, skipping those the other side has out of order.
+func (self *Comm) retransmit() {
+	self.recvLock.Lock()
+	defer self.recvLock.Unlock()
+	now := time.Now().UnixNano()
+	timeout := int64(self.rto.rto)
+	resent := false
+	for _, session := range self.Sessions() {
+		session.packetsLock.Lock()
+		for p, h := session.packets.tail, session.packets.head; p != h; p = p.next {
+			sent := atomic.LoadInt64(&p.sent)
+			if p.sacked || sent == 0 || now-sent < timeout {
+				continue
+			}
+			atomic.StoreInt64(&p.sent, 0)
+			p.retries++
+			session.queue(p)
+			atomic.AddUint64(&self.Retransmits, 1)
+			resent = true
+		}
+		session.packetsLock.Unlock()
+	}
+	if resent {
+		self.rto.backoff()
+	}
+}
+
+// jitter returns a random duration within d - spread to d + spread.
+func jitter(d, spread time.Duration) time.Duration {
+	if spread <= 0 {
+		return d
+	}
+	return d - spread + time.Duration(rand.Int63n(int64(spread)*2))
+}
+
 func (self *Comm) Close() {
-	self.conn.Close()
-	close(self.stopSender)
+	self.stopLinks()
 	close(self.stopAck)
-	<-self.stoppedReader
-	<-self.stoppedSender
+	self.linksWait.Wait()
 	<-self.stoppedAck
 	close(self.eventsIn)
 	close(self.ackQueueIn)
-	close(self.sendQueueIn)
 	self.IsClosed = true
 }
 
@@ -285,15 +713,20 @@ func (self *Comm) NewSession(id int64, data []byte, obj interface{}) *Session {
 		id = rand.Int63()
 	}
 	session := &Session{
-		Id:        id,
-		comm:      self,
-		Obj:       obj,
-		packets:   NewQueue(),
-		StartTime: time.Now(),
+		Id:         id,
+		comm:       self,
+		Obj:        obj,
+		packets:    NewQueue(),
+		pending:    make(map[uint32]*Packet),
+		StartTime:  time.Now(),
+		lastActive: time.Now().UnixNano(),
 	}
+	session.creditCond = sync.NewCond(&session.creditLock)
 	if isNew {
 		session.sendPacket(typeConnect, data)
 	}
-	self.Sessions[id] = session
+	self.sessionsLock.Lock()
+	self.sessions[id] = session
+	self.sessionsLock.Unlock()
 	return session
 }
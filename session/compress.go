@@ -0,0 +1,106 @@
+package session
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sync"
+)
+
+var (
+	// data shorter than this is not worth compressing
+	MIN_COMPRESS_LENGTH = 64
+	// data with more bits of entropy per byte than this looks compressed
+	// or encrypted already
+	MAX_COMPRESS_ENTROPY = 7.0
+	COMPRESSION_LEVEL    = flate.BestSpeed
+)
+
+var errDecompress = errors.New("decompression failed")
+
+// flate writers are big, so they are kept for the next session
+var compressors sync.Pool
+
+// compressor compresses the data of one direction of a session as one flate
+// stream, flushed after every packet, so later packets refer back to
+// earlier ones. Packets are decompressed in serial order by the other side.
+type compressor struct {
+	buf    bytes.Buffer
+	writer *flate.Writer
+}
+
+func (self *compressor) compress(data []byte) []byte {
+	if self.writer == nil {
+		if w, ok := compressors.Get().(*flate.Writer); ok {
+			w.Reset(&self.buf)
+			self.writer = w
+		} else {
+			self.writer, _ = flate.NewWriter(&self.buf, COMPRESSION_LEVEL)
+		}
+	}
+	self.buf.Reset()
+	var length [2]byte
+	binary.LittleEndian.PutUint16(length[:], uint16(len(data)))
+	self.buf.Write(length[:])
+	self.writer.Write(data)
+	self.writer.Flush()
+	return append([]byte(nil), self.buf.Bytes()...)
+}
+
+func (self *compressor) close() {
+	if self.writer != nil {
+		compressors.Put(self.writer)
+		self.writer = nil
+	}
+}
+
+type decompressor struct {
+	src    bytes.Buffer
+	reader io.ReadCloser
+}
+
+// decompress takes the payload of the next compressed packet. The
+// uncompressed length comes first, so exactly the output of this packet is
+// read and the flate reader never runs out of input.
+func (self *decompressor) decompress(data []byte) ([]byte, error) {
+	if len(data) < 2 {
+		return nil, errDecompress
+	}
+	if self.reader == nil {
+		self.reader = flate.NewReader(&self.src)
+	}
+	self.src.Write(data[2:])
+	ret := make([]byte, binary.LittleEndian.Uint16(data))
+	if _, err := io.ReadFull(self.reader, ret); err != nil {
+		return nil, errDecompress
+	}
+	return ret, nil
+}
+
+// compressible tells if data is long enough and does not look compressed
+// already, by the entropy of its bytes.
+func compressible(data []byte) bool {
+	if len(data) < MIN_COMPRESS_LENGTH {
+		return false
+	}
+	if len(data) > 1024 {
+		data = data[:1024]
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c == 0 {
+			continue
+		}
+		p := float64(c) / float64(len(data))
+		entropy -= p * math.Log2(p)
+	}
+	// a short sample of random bytes cannot show all the entropy they have
+	return entropy <= math.Min(MAX_COMPRESS_ENTROPY, math.Log2(float64(len(data)))-1)
+}
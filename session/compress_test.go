@@ -0,0 +1,55 @@
+package session
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+)
+
+func TestCompressor(t *testing.T) {
+	var c compressor
+	var d decompressor
+	defer c.close()
+	total, compressed := 0, 0
+	for i := 0; i < 256; i++ {
+		data := []byte(fmt.Sprintf(`{"id": %d, "name": "session %d", "status": "ok"}`, i, i))
+		data = bytes.Repeat(data, i%8+1)
+		out := c.compress(data)
+		total += len(data)
+		compressed += len(out)
+		got, err := d.decompress(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("data not match")
+		}
+	}
+	if compressed*4 > total {
+		t.Fatalf("compressed %d to %d", total, compressed)
+	}
+	if _, err := d.decompress([]byte{0xff}); err == nil {
+		t.Fatal("bad data accepted")
+	}
+}
+
+func TestCompressible(t *testing.T) {
+	random := make([]byte, 1280)
+	rand.Read(random)
+	text := bytes.Repeat([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), 32)
+	for _, c := range []struct {
+		data     []byte
+		expected bool
+	}{
+		{random, false},
+		{random[:64], false},
+		{text, true},
+		{text[:64], true},
+		{text[:16], false},
+	} {
+		if compressible(c.data) != c.expected {
+			t.Fatalf("%d bytes compressible not %v", len(c.data), c.expected)
+		}
+	}
+}
@@ -1,8 +1,38 @@
 package session
 
 const (
-	typeConnect = uint8(0)
-	typeData    = uint8(1)
-	typeSignal  = uint8(2)
-	typeAck     = uint8(3)
+	typeConnect  = uint8(0)
+	typeData     = uint8(1)
+	typeSignal   = uint8(2)
+	typeAck      = uint8(3)
+	typeRekey    = uint8(4)
+	typeCover    = uint8(5)
+	typeWindow   = uint8(6)
+	typePriority = uint8(7)
+)
+
+// flags in the type byte of data packets
+const (
+	flagCompressed = uint8(0x80) // the payload is compressed
+	flagMore       = uint8(0x40) // more fragments of the data follow
+)
+
+// features negotiated per connection
+const (
+	FEATURE_OBFUSCATION = uint32(1 << iota) // padding, cover packets and ack jitter
+	FEATURE_COMPRESSION                     // data of sessions is compressed
+	FEATURE_PRIORITY                        // sessions tell their priority class
+)
+
+// all features this side knows
+const FEATURES = FEATURE_OBFUSCATION | FEATURE_COMPRESSION | FEATURE_PRIORITY
+
+// versions of the wire format. A Comm speaks PROTOCOL_VERSION, and the
+// server grants versions from MIN_PROTOCOL_VERSION up. Nothing has been
+// released yet, so version 1 covers the whole format. A change after a
+// release takes a new version, and what it changes is gated on Keys.Version
+// for as long as older versions are served.
+const (
+	PROTOCOL_VERSION     = uint16(1)
+	MIN_PROTOCOL_VERSION = uint16(1)
 )
@@ -0,0 +1,58 @@
+package session
+
+import (
+	"time"
+)
+
+var (
+	// bounds of the retransmission timeout. Acks are delayed by up to
+	// ACK_INTERVAL, which the round trip samples include.
+	INITIAL_RTO = time.Second * 3
+	MIN_RTO     = time.Second
+	MAX_RTO     = time.Minute
+)
+
+// rtoEstimator keeps the retransmission timeout from round trip samples, as
+// in RFC 6298.
+type rtoEstimator struct {
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+}
+
+func newRTOEstimator() *rtoEstimator {
+	return &rtoEstimator{
+		rto: INITIAL_RTO,
+	}
+}
+
+// sample takes the round trip time of a packet that was sent once.
+func (self *rtoEstimator) sample(rtt time.Duration) {
+	if self.srtt == 0 {
+		self.srtt = rtt
+		self.rttvar = rtt / 2
+	} else {
+		delta := self.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		self.rttvar = (self.rttvar*3 + delta) / 4
+		self.srtt = (self.srtt*7 + rtt) / 8
+	}
+	self.rto = self.clamp(self.srtt + self.rttvar*4)
+}
+
+// backoff doubles the timeout after a retransmission.
+func (self *rtoEstimator) backoff() {
+	self.rto = self.clamp(self.rto * 2)
+}
+
+func (self *rtoEstimator) clamp(rto time.Duration) time.Duration {
+	if rto < MIN_RTO {
+		return MIN_RTO
+	}
+	if rto > MAX_RTO {
+		return MAX_RTO
+	}
+	return rto
+}
@@ -0,0 +1,39 @@
+package session
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTOEstimator(t *testing.T) {
+	e := newRTOEstimator()
+	if e.rto != INITIAL_RTO {
+		t.Fatal("initial rto not match")
+	}
+	e.sample(time.Second)
+	if e.srtt != time.Second || e.rto != time.Second*3 {
+		t.Fatal("first sample not match ", e.srtt, e.rto)
+	}
+	for i := 0; i < 64; i++ {
+		e.sample(time.Second * 2)
+	}
+	if e.srtt < time.Millisecond*1990 || e.rto > time.Millisecond*2100 {
+		t.Fatal("rto not converged ", e.srtt, e.rto)
+	}
+	e.backoff()
+	if e.rto < time.Second*4 {
+		t.Fatal("rto not backed off ", e.rto)
+	}
+	for i := 0; i < 16; i++ {
+		e.backoff()
+	}
+	if e.rto != MAX_RTO {
+		t.Fatal("rto not bounded ", e.rto)
+	}
+	for i := 0; i < 64; i++ {
+		e.sample(time.Millisecond)
+	}
+	if e.rto != MIN_RTO {
+		t.Fatal("rto not bounded ", e.rto)
+	}
+}
@@ -0,0 +1,135 @@
+package session
+
+import (
+	"sync"
+)
+
+// priority classes of sessions. The classes take turns by deficit
+// round-robin too, each turn of a class adding its weight in quanta to what
+// it may send, so a busy high class gets most of the link without starving
+// the normal one.
+const (
+	PRIORITY_NORMAL = uint8(0)
+	PRIORITY_HIGH   = uint8(1)
+
+	priorities = 2
+)
+
+// each turn of a session adds this many bytes to what it may send
+var QUANTUM = 8192
+
+// the quanta each turn of a class adds, by priority
+var PRIORITY_WEIGHTS = [priorities]int{1, 4}
+
+// scheduler is the send queue of a Comm. Packets wait in a queue per
+// session, and the sessions of a class take turns by deficit round-robin,
+// so a bulk transfer does not hold up the other sessions.
+type scheduler struct {
+	lock    sync.Mutex
+	classes [priorities]drrClass
+	turn    int           // the class whose turn it is
+	ready   chan struct{} // has a value when packets may be waiting
+}
+
+type drrClass struct {
+	active  []*flow // sessions with packets waiting, in turn order
+	flows   map[int64]*flow
+	deficit int // what the class may still send in its turn, overdrawn by at most a packet
+}
+
+type flow struct {
+	packets []*Packet
+	deficit int
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		ready: make(chan struct{}, 1),
+	}
+	for i := range s.classes {
+		s.classes[i].flows = make(map[int64]*flow)
+	}
+	return s
+}
+
+// push queues a packet of a session in the class of priority.
+func (self *scheduler) push(packet *Packet, priority uint8) {
+	if int(priority) >= priorities {
+		priority = priorities - 1
+	}
+	self.lock.Lock()
+	class := &self.classes[priority]
+	f, ok := class.flows[packet.sessionId]
+	if !ok {
+		f = &flow{}
+		class.flows[packet.sessionId] = f
+		class.active = append(class.active, f)
+	}
+	f.packets = append(f.packets, packet)
+	self.lock.Unlock()
+	self.signal()
+}
+
+// pop returns the next packet to send, or nil if there is none.
+func (self *scheduler) pop() *Packet {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.waiting() {
+		class := &self.classes[self.turn]
+		if len(class.active) > 0 && class.deficit > 0 {
+			packet := class.next()
+			class.deficit -= HEADER_LENGTH + len(packet.data)
+			if len(class.active) == 0 { // an idle class keeps nothing for later
+				class.deficit = 0
+			}
+			if self.waiting() {
+				self.signal()
+			}
+			return packet
+		}
+		// the turn is over
+		self.turn = (self.turn + 1) % priorities
+		if next := &self.classes[self.turn]; len(next.active) > 0 {
+			next.deficit += PRIORITY_WEIGHTS[self.turn] * QUANTUM
+		}
+	}
+	return nil
+}
+
+func (self *scheduler) waiting() bool {
+	for i := range self.classes {
+		if len(self.classes[i].active) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *scheduler) signal() {
+	select {
+	case self.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (self *drrClass) next() *Packet {
+	for len(self.active) > 0 {
+		f := self.active[0]
+		packet := f.packets[0]
+		size := HEADER_LENGTH + len(packet.data)
+		if f.deficit < size { // turn is over
+			f.deficit += QUANTUM
+			self.active = append(self.active[1:], f)
+			continue
+		}
+		f.deficit -= size
+		f.packets[0] = nil
+		f.packets = f.packets[1:]
+		if len(f.packets) == 0 {
+			self.active = self.active[1:]
+			delete(self.flows, packet.sessionId)
+		}
+		return packet
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package session
+
+import (
+	"testing"
+)
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler()
+	// a bulk session queues first
+	for i := 0; i < 16; i++ {
+		s.push(&Packet{sessionId: 1, data: make([]byte, MAX_FRAGMENT_LENGTH)}, PRIORITY_NORMAL)
+	}
+	for i := 0; i < 4; i++ {
+		s.push(&Packet{sessionId: 2, data: make([]byte, 100)}, PRIORITY_NORMAL)
+	}
+	// the small session is done long before the bulk one
+	n := 0
+	for p := s.pop(); p != nil; p = s.pop() {
+		n++
+		if p.sessionId == 2 && n > 8 {
+			t.Fatal("small session starved", n)
+		}
+	}
+	if n != 20 {
+		t.Fatal("packets lost", n)
+	}
+
+	// a busy high class gets most of the link by its weight, and the
+	// normal class still gets its share
+	for i := 0; i < 200; i++ {
+		s.push(&Packet{sessionId: 1, data: make([]byte, 1000)}, PRIORITY_NORMAL)
+		s.push(&Packet{sessionId: 3, data: make([]byte, 1000)}, PRIORITY_HIGH)
+	}
+	sent := make(map[int64]int)
+	for i := 0; i < 200; i++ {
+		sent[s.pop().sessionId]++
+	}
+	weight := float64(PRIORITY_WEIGHTS[PRIORITY_HIGH]) / float64(PRIORITY_WEIGHTS[PRIORITY_NORMAL])
+	if ratio := float64(sent[3]) / float64(sent[1]); sent[1] == 0 || ratio < weight*0.8 || ratio > weight*1.2 {
+		t.Fatal("classes not weighted", sent[3], sent[1])
+	}
+	for p := s.pop(); p != nil; p = s.pop() {
+	}
+	// packets of a session keep their order
+	for i := uint32(1); i <= 4; i++ {
+		s.push(&Packet{sessionId: 4, serial: i}, PRIORITY_NORMAL)
+	}
+	var last uint32
+	for p := s.pop(); p != nil; p = s.pop() {
+		if p.sessionId == 4 {
+			if p.serial != last+1 {
+				t.Fatal("order not kept")
+			}
+			last = p.serial
+		}
+	}
+	if last != 4 {
+		t.Fatal("packets lost")
+	}
+}
@@ -1,25 +1,54 @@
 package session
 
 import (
-	"bytes"
-	"crypto/aes"
 	"encoding/binary"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 const OLD_SESSION_DATA_SENT = 1024 * 1024 * 4
 
+// Flow control: a session may have at most WINDOW bytes of data sent but not
+// yet consumed by the other side. The receiver grants more by telling the
+// sender how many bytes it has consumed in total, once it has consumed half
+// a window since the last update, and again with the acks.
+var WINDOW = uint64(256 * 1024)
+
+// Data longer than MAX_FRAGMENT_LENGTH is sent in fragments, which leaves
+// room in a packet for compression to grow it. The other side joins data of
+// up to MAX_MESSAGE_LENGTH bytes.
+var (
+	MAX_FRAGMENT_LENGTH = 1 << 15
+	MAX_MESSAGE_LENGTH  = 1 << 24
+)
+
 type Session struct {
 	Id                int64
 	comm              *Comm
 	Obj               interface{}
-	dataSent          uint64
-	serial            uint32 // next packet serial
-	maxReceivedSerial uint32
-	maxAckSerial      uint32
-	packets           *Queue // packet buffer
+	serial            uint32             // next packet serial
+	maxReceivedSerial uint32             // guarded by the comm's recvLock
+	maxAckSerial      uint32             // accessed atomically
+	ackNeeded         bool               // a duplicate came, so the last ack may be lost
+	packets           *Queue             // packet buffer, of packets sent and not acked yet
+	packetsLock       sync.Mutex         // guards packets
+	pending           map[uint32]*Packet // packets received out of order
 	StartTime         time.Time
+	lastActive        int64 // unix nano time of the last packet sent or received, accessed atomically
+	compressor        compressor
+	decompressor      decompressor // used by the comm reader only
+	fragments         []byte       // data received before the last fragment
+	priority          uint32       // PRIORITY_* class, accessed atomically
+
+	creditLock   sync.Mutex
+	creditCond   *sync.Cond
+	closed       bool
+	dataSent     uint64 // bytes of data sent, counted against the window
+	peerConsumed uint64 // bytes the other side has consumed
+	consumed     uint64 // bytes of data consumed, read atomically by acker
+	advertised   uint64 // consumed as last told to the other side
 }
 
 func (self *Session) nextSerial() uint32 {
@@ -27,34 +56,175 @@ func (self *Session) nextSerial() uint32 {
 }
 
 func (self *Session) sendPacket(t uint8, data []byte) {
-	buf := new(bytes.Buffer)
-	buf.Grow(len(data) + 4 + 8 + 1)
-	serial := self.nextSerial()
-	binary.Write(buf, binary.LittleEndian, serial)
-	binary.Write(buf, binary.LittleEndian, self.Id)
-	binary.Write(buf, binary.LittleEndian, t)
-	block, _ := aes.NewCipher(self.comm.key)
-	v := make([]byte, aes.BlockSize)
-	var i, size int
-	for i, size = aes.BlockSize, len(data); i < size; i += aes.BlockSize {
-		block.Encrypt(v, data[i-aes.BlockSize:i])
-		buf.Write(v)
-	}
-	buf.Write(data[i-aes.BlockSize:])
-	packet := &Packet{serial: serial, data: buf.Bytes()}
-	self.comm.sendQueueIn <- packet
+	self.enqueue(&Packet{
+		t:    t,
+		data: data,
+	})
+}
+
+// enqueue numbers a packet and queues it to send, keeping it until acked.
+// Packets are numbered and queued in one step, so that they are queued in
+// serial order whatever goroutines send them.
+func (self *Session) enqueue(packet *Packet) {
+	packet.sessionId = self.Id
+	self.active()
+	self.packetsLock.Lock()
+	packet.serial = self.nextSerial()
 	self.packets.En(packet)
-	self.dataSent += uint64(len(data))
+	self.queue(packet)
+	self.packetsLock.Unlock()
+}
+
+func (self *Session) active() {
+	atomic.StoreInt64(&self.lastActive, time.Now().UnixNano())
+}
+
+// LastActive returns when the session last sent or received a packet of
+// its own; acks and window updates do not count.
+func (self *Session) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&self.lastActive))
 }
 
+// unacked returns the packets sent and not acked yet, oldest first.
+func (self *Session) unacked() []*Packet {
+	self.packetsLock.Lock()
+	defer self.packetsLock.Unlock()
+	var packets []*Packet
+	for p, h := self.packets.tail, self.packets.head; p != h; p = p.next {
+		packets = append(packets, p)
+	}
+	return packets
+}
+
+// queue puts a packet in the send queue, in the class of the session
+func (self *Session) queue(packet *Packet) {
+	self.comm.sched.push(packet, uint8(atomic.LoadUint32(&self.priority)))
+}
+
+// send one fragment of data, more is set on all but the last
+func (self *Session) sendFragment(data []byte, more bool) {
+	packet := &Packet{
+		t:    typeData,
+		data: data,
+		more: more,
+	}
+	if self.comm.compressing() && compressible(data) {
+		packet.data = self.compressor.compress(data)
+		packet.compressed = true
+	}
+	atomic.AddUint64(&self.comm.UncompressedSent, uint64(len(data)))
+	atomic.AddUint64(&self.comm.CompressedSent, uint64(len(packet.data)))
+	self.enqueue(packet)
+}
+
+// Send sends data of any length, using up credit of the session's window.
+// The other side gets it in one DATA event. It does not block; a reader of
+// the data should wait with WaitCredit first.
 func (self *Session) Send(data []byte) {
-	self.sendPacket(typeData, data)
+	self.creditLock.Lock()
+	self.dataSent += uint64(len(data))
+	self.creditLock.Unlock()
+	for len(data) > MAX_FRAGMENT_LENGTH {
+		self.sendFragment(data[:MAX_FRAGMENT_LENGTH], true)
+		data = data[MAX_FRAGMENT_LENGTH:]
+	}
+	self.sendFragment(data, false)
+}
+
+// WaitCredit blocks until the window of the session has room. It returns
+// false if the session is closed.
+func (self *Session) WaitCredit() bool {
+	self.creditLock.Lock()
+	defer self.creditLock.Unlock()
+	for !self.closed && self.dataSent >= self.peerConsumed+WINDOW {
+		self.creditCond.Wait()
+	}
+	return !self.closed
+}
+
+// Consumed tells the session that n bytes of received data were consumed,
+// e.g. written to the connection they were for, so the other side may send
+// more.
+func (self *Session) Consumed(n int) {
+	consumed := atomic.AddUint64(&self.consumed, uint64(n))
+	if consumed-self.advertised >= WINDOW/2 {
+		self.advertised = consumed
+		self.comm.ackQueueIn <- self.windowPacket(consumed)
+	}
+}
+
+func (self *Session) windowPacket(consumed uint64) *Packet {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, consumed)
+	return &Packet{
+		sessionId: self.Id,
+		t:         typeWindow,
+		data:      data,
+	}
+}
+
+// called with the consumed count from a window update
+func (self *Session) grant(consumed uint64) {
+	self.creditLock.Lock()
+	if consumed > self.peerConsumed {
+		self.peerConsumed = consumed
+		self.creditCond.Broadcast()
+	}
+	self.creditLock.Unlock()
 }
 
 func (self *Session) Signal(sig uint8) {
 	self.sendPacket(typeSignal, []byte{sig})
 }
 
+// SetPriority puts the session in a PRIORITY_* class, on this side and, if
+// the other side knows priorities, on that side too.
+func (self *Session) SetPriority(priority uint8) {
+	atomic.StoreUint32(&self.priority, uint32(priority))
+	if self.comm.prioritizing() {
+		self.sendPacket(typePriority, []byte{priority})
+	}
+}
+
+// SignalData sends a signal with data, which follows sig in the event data.
+func (self *Session) SignalData(sig uint8, data []byte) {
+	self.sendPacket(typeSignal, append([]byte{sig}, data...))
+}
+
+// sackRanges returns the ranges of serials received out of order, as first
+// and last serial of each, for the other side not to send them again.
+func (self *Session) sackRanges() []byte {
+	if len(self.pending) == 0 {
+		return nil
+	}
+	serials := make([]int, 0, len(self.pending))
+	for serial := range self.pending {
+		serials = append(serials, int(serial))
+	}
+	sort.Ints(serials)
+	var data []byte
+	first := serials[0]
+	for i := 1; i <= len(serials); i++ {
+		if i < len(serials) && serials[i] == serials[i-1]+1 {
+			continue
+		}
+		data = binary.LittleEndian.AppendUint32(data, uint32(first))
+		data = binary.LittleEndian.AppendUint32(data, uint32(serials[i-1]))
+		if len(data) == MAX_SACK_RANGES*8 || i == len(serials) {
+			break
+		}
+		first = serials[i]
+	}
+	return data
+}
+
 func (self *Session) Close() {
-	delete(self.comm.Sessions, self.Id)
+	self.comm.sessionsLock.Lock()
+	delete(self.comm.sessions, self.Id)
+	self.comm.sessionsLock.Unlock()
+	self.compressor.close()
+	self.creditLock.Lock()
+	self.closed = true
+	self.creditCond.Broadcast()
+	self.creditLock.Unlock()
 }
@@ -2,8 +2,12 @@ package session
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -37,9 +41,10 @@ func TestSession(t *testing.T) {
 	}
 	conn1, conn2 := getConns()
 
-	key := bytes.Repeat([]byte("foo bar "), 3)
-	comm1 := NewComm(conn1, key)
-	comm2 := NewComm(conn2, key)
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
 
 	greeting := []byte("hello")
 	session1 := comm1.NewSession(0, greeting, nil)
@@ -84,16 +89,19 @@ func TestSession(t *testing.T) {
 		t.Fatal("event not match here")
 	}
 
-	if session2.maxReceivedSerial < uint32(n) {
+	comm2.recvLock.Lock()
+	maxReceivedSerial := session2.maxReceivedSerial
+	comm2.recvLock.Unlock()
+	if maxReceivedSerial < uint32(n) {
 		t.Fatal("serial not match")
 	}
 
 	<-time.After(time.Millisecond * 1000)
-	if session1.maxAckSerial == 0 {
+	if atomic.LoadUint32(&session1.maxAckSerial) == 0 {
 		t.Fatal("no ack received")
 	}
 
-	if comm1.BytesSent != comm2.BytesReceived {
+	if atomic.LoadUint64(&comm1.BytesSent) != atomic.LoadUint64(&comm2.BytesReceived) {
 		t.Fatal("bytes sent not equal to bytes received")
 	}
 
@@ -108,13 +116,12 @@ func TestSession(t *testing.T) {
 
 	// test connection reset
 	conn1, conn2 = getConns()
-	comm1 = NewComm(conn1, key)
-	comm2 = NewComm(conn2, key)
+	comm1 = NewComm(conn1, key1, key2, 0)
+	comm2 = NewComm(conn2, key2, key1, 0)
 	n = 20480
 	go func() {
 		x := 0
-		for {
-			ev := <-comm2.Events
+		for ev := range comm2.Events {
 			if ev.Type != DATA {
 				continue
 			}
@@ -131,9 +138,636 @@ func TestSession(t *testing.T) {
 		session1.Send([]byte(fmt.Sprintf("data-%d", i)))
 		if i%128 == 0 {
 			conn1, conn2 = getConns()
-			comm1.UseConn(conn1)
-			comm2.UseConn(conn2)
+			comm1.UseConn(conn1, key2, key1, 0)
+			comm2.UseConn(conn2, key1, key2, 0)
 			fmt.Printf("connection reset at %d, %v %v\n", i, conn1.RemoteAddr(), conn2.LocalAddr())
 		}
 	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestTamperedPacket(t *testing.T) {
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:42223")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn1, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm := NewComm(conn2, key1, key2, 0)
+	defer comm.Close()
+	sender := &link{}
+	sender.sendCipher, _ = newFrameCipher(key2)
+
+	// valid packet
+	conn1.Write(sender.encode(&Packet{serial: 1, sessionId: 42, t: typeConnect, data: []byte("hello")}))
+	var ev Event
+	select {
+	case ev = <-comm.Events:
+	case <-time.After(time.Second * 1):
+		t.Fatal("event timeout")
+	}
+	if ev.Type != SESSION || string(ev.Data) != "hello" {
+		t.Fatal("valid packet not accepted")
+	}
+
+	// tampered packet
+	frame := sender.encode(&Packet{serial: 2, sessionId: 42, t: typeData, data: []byte("world")})
+	frame[len(frame)-1] ^= 1
+	conn1.Write(frame)
+	select {
+	case ev = <-comm.Events:
+	case <-time.After(time.Second * 1):
+		t.Fatal("event timeout")
+	}
+	if ev.Type != ERROR {
+		t.Fatal("tampered packet not rejected")
+	}
+}
+
+func TestFrameCipher(t *testing.T) {
+	key := bytes.Repeat([]byte("foo bar "), 3)
+	sender, _ := newFrameCipher(key)
+	receiver, _ := newFrameCipher(key)
+	frame1 := sender.seal(nil, []byte("hello"))
+	frame2 := sender.seal(nil, []byte("world"))
+	// a frame that fails to open leaves the counter where it was
+	tampered := append([]byte(nil), frame1...)
+	tampered[0] ^= 1
+	if _, err := receiver.open(tampered); err == nil {
+		t.Fatal("tampered frame opened")
+	}
+	for i, frame := range [][]byte{frame1, frame2} {
+		data, err := receiver.open(frame)
+		if err != nil || string(data) != []string{"hello", "world"}[i] {
+			t.Fatal("frame not opened after a failed one", err)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	REKEY_BYTES = 4096
+	defer func() { REKEY_BYTES = uint64(1 << 30) }()
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:42224")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	getConns := func() (*net.TCPConn, *net.TCPConn) {
+		conn1, err := net.DialTCP("tcp", nil, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn2, err := ln.AcceptTCP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn1, conn2
+	}
+
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	conn1, conn2 := getConns()
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
+	session1 := comm1.NewSession(-1, nil, nil)
+	n := 1024
+	for i := 0; i < n; i++ {
+		session1.Send([]byte(fmt.Sprintf("data-%d", i)))
+		if i == n/2 { // resume with retransmission in the middle
+			conn1, conn2 = getConns()
+			comm1.UseConn(conn1, key1, key2, 0)
+			comm2.UseConn(conn2, key2, key1, 0)
+		}
+	}
+	x := 0
+	for x < n {
+		var ev Event
+		select {
+		case ev = <-comm2.Events:
+		case <-time.After(time.Second * 1):
+			t.Fatal("event timeout")
+		}
+		if ev.Type == ERROR {
+			t.Fatal(string(ev.Data))
+		}
+		if ev.Type != DATA {
+			continue
+		}
+		if string(ev.Data) != fmt.Sprintf("data-%d", x) {
+			t.Fatal("data not match ", string(ev.Data))
+		}
+		x += 1
+	}
+	if comm2.links[0].recvCipher.epoch == 0 {
+		t.Fatal("no rekey")
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestObfuscation(t *testing.T) {
+	COVER_INTERVAL = time.Millisecond * 10
+	defer func() { COVER_INTERVAL = time.Second * 2 }()
+	addr, err := net.ResolveTCPAddr("tcp", "localhost:42225")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn1, err := net.DialTCP("tcp", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn2, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm1 := NewComm(conn1, key1, key2, FEATURE_OBFUSCATION)
+	comm2 := NewComm(conn2, key2, key1, FEATURE_OBFUSCATION)
+	session1 := comm1.NewSession(-1, nil, nil)
+	n := 256
+	for i := 0; i < n; i++ {
+		session1.Send([]byte(fmt.Sprintf("data-%d", i)))
+		time.Sleep(time.Millisecond)
+	}
+	for x := 0; x < n; {
+		var ev Event
+		select {
+		case ev = <-comm2.Events:
+		case <-time.After(time.Second * 1):
+			t.Fatal("event timeout")
+		}
+		if ev.Type == ERROR {
+			t.Fatal(string(ev.Data))
+		}
+		if ev.Type != DATA {
+			continue
+		}
+		if string(ev.Data) != fmt.Sprintf("data-%d", x) {
+			t.Fatal("data not match ", string(ev.Data))
+		}
+		x += 1
+	}
+	if atomic.LoadUint64(&comm2.BytesReceived) < uint64(n*MAX_PADDING/4) {
+		t.Fatal("no padding or cover packets")
+	}
+
+	// frame lengths vary
+	sender := &link{features: FEATURE_OBFUSCATION}
+	sender.sendCipher, _ = newFrameCipher(key1)
+	lengths := make(map[int]bool)
+	for i := 0; i < 16; i++ {
+		lengths[len(sender.encode(&Packet{t: typeData, data: []byte("foo")}))] = true
+	}
+	if len(lengths) < 2 {
+		t.Fatal("frame length not padded")
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestPipe(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
+	session1 := comm1.NewSession(-1, []byte("hello"), nil)
+	session1.Send([]byte("world"))
+	for _, expected := range []string{"hello", "world"} {
+		select {
+		case ev := <-comm2.Events:
+			if string(ev.Data) != expected {
+				t.Fatal("data not match")
+			}
+		case <-time.After(time.Second * 1):
+			t.Fatal("event timeout")
+		}
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestFlowControl(t *testing.T) {
+	WINDOW = 4096
+	defer func() { WINDOW = uint64(256 * 1024) }()
+	conn1, conn2 := net.Pipe()
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
+	session1 := comm1.NewSession(-1, nil, nil)
+
+	// the sender stops when the window is used up
+	sent := make(chan int)
+	go func() {
+		n := 0
+		for n < int(WINDOW)*4 && session1.WaitCredit() {
+			session1.Send(make([]byte, 1024))
+			n += 1024
+			sent <- n
+		}
+		close(sent)
+	}()
+	n := 0
+	for stalled := false; !stalled; {
+		select {
+		case n = <-sent:
+		case <-time.After(time.Millisecond * 200):
+			stalled = true
+		}
+	}
+	if n != int(WINDOW) {
+		t.Fatalf("sent %d bytes without credit", n)
+	}
+
+	// consuming on the other side grants more
+	var session2 *Session
+	received := 0
+	for received < int(WINDOW)*4 {
+		select {
+		case ev := <-comm2.Events:
+			switch ev.Type {
+			case SESSION:
+				session2 = ev.Session
+			case DATA:
+				received += len(ev.Data)
+				session2.Consumed(len(ev.Data))
+			case ERROR:
+				t.Fatal(string(ev.Data))
+			}
+		case n = <-sent:
+		case <-time.After(time.Second * 2):
+			t.Fatalf("stalled after %d bytes", received)
+		}
+	}
+
+	// closing the session releases a waiting reader
+	session1.Send(make([]byte, int(WINDOW)))
+	done := make(chan bool)
+	go func() {
+		done <- session1.WaitCredit()
+	}()
+	session1.Close()
+	select {
+	case ok := <-done:
+		if ok {
+			t.Fatal("credit on closed session")
+		}
+	case <-time.After(time.Second * 1):
+		t.Fatal("reader not released")
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestStriping(t *testing.T) {
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	conn1, conn2 := net.Pipe()
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn1, conn2 := net.Pipe()
+		comm1.AddConn(conn1, key1, key2, 0)
+		comm2.AddConn(conn2, key2, key1, 0)
+		conns = append(conns, conn1)
+	}
+	if comm1.Conns() != 4 || comm2.Conns() != 4 {
+		t.Fatal("conns not added")
+	}
+
+	n := 4096
+	received := make(chan int)
+	go func() {
+		x := 0
+		for ev := range comm2.Events {
+			if ev.Type == ERROR {
+				fmt.Printf("%s\n", ev.Data)
+				break
+			}
+			if ev.Type != DATA {
+				continue
+			}
+			if string(ev.Data) != fmt.Sprintf("data-%d", x) {
+				break
+			}
+			ev.Session.Consumed(len(ev.Data))
+			x += 1
+			received <- x
+		}
+		close(received)
+	}()
+	session1 := comm1.NewSession(-1, nil, nil)
+	for i := 0; i < n; i++ {
+		if i == n/2 { // losing a connection loses nothing
+			conns[0].Close()
+		}
+		session1.WaitCredit()
+		session1.Send([]byte(fmt.Sprintf("data-%d", i)))
+	}
+	for x := 0; x < n; {
+		select {
+		case v, ok := <-received:
+			if !ok {
+				t.Fatalf("data out of order after %d packets", x)
+			}
+			x = v
+		case <-time.After(time.Second * 2):
+			t.Fatalf("timeout after %d packets", x)
+		}
+	}
+	if comm1.Conns() != 3 {
+		t.Fatal("closed conn not dropped")
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+// stalledConn takes one write and then blocks until closed, like a
+// connection that stopped moving.
+type stalledConn struct {
+	net.Conn
+	writes int
+	closed chan struct{}
+}
+
+func (self *stalledConn) Write(b []byte) (int, error) {
+	self.writes++
+	if self.writes > 1 {
+		<-self.closed
+		return 0, io.ErrClosedPipe
+	}
+	return len(b), nil
+}
+
+func (self *stalledConn) Close() error {
+	select {
+	case <-self.closed:
+	default:
+		close(self.closed)
+	}
+	return self.Conn.Close()
+}
+
+func TestRetransmission(t *testing.T) {
+	MIN_RTO = time.Millisecond * 200
+	defer func() { MIN_RTO = time.Second }()
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	conn1, conn2 := net.Pipe()
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
+	session1 := comm1.NewSession(-1, nil, nil)
+	// the first packets go on the good conn only
+	for i := 0; i < 10; i++ {
+		session1.Send([]byte(fmt.Sprintf("data-%d", i)))
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// packets on the stalled conn are lost
+	conn3, conn4 := net.Pipe()
+	comm1.AddConn(&stalledConn{Conn: conn3, closed: make(chan struct{})}, key1, key2, 0)
+	comm2.AddConn(conn4, key2, key1, 0)
+	n := 256
+	for i := 10; i < n; i++ {
+		session1.Send([]byte(fmt.Sprintf("data-%d", i)))
+	}
+	for x := 0; x < n; {
+		var ev Event
+		select {
+		case ev = <-comm2.Events:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timeout after %d packets", x)
+		}
+		if ev.Type == ERROR {
+			t.Fatal(string(ev.Data))
+		}
+		if ev.Type != DATA {
+			continue
+		}
+		if string(ev.Data) != fmt.Sprintf("data-%d", x) {
+			t.Fatal("data not match ", string(ev.Data))
+		}
+		x += 1
+	}
+	// packets after the lost ones were acked selectively
+	if retransmits := atomic.LoadUint64(&comm1.Retransmits); retransmits == 0 || retransmits > 4 {
+		t.Fatalf("%d packets retransmitted", retransmits)
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestSackRanges(t *testing.T) {
+	session := &Session{pending: make(map[uint32]*Packet)}
+	if session.sackRanges() != nil {
+		t.Fatal("ranges without pending packets")
+	}
+	for _, serial := range []uint32{5, 6, 7, 9, 12, 13} {
+		session.pending[serial] = &Packet{serial: serial}
+	}
+	expected := []uint32{5, 7, 9, 9, 12, 13}
+	data := session.sackRanges()
+	if len(data) != len(expected)*4 {
+		t.Fatal("ranges not match")
+	}
+	for i, serial := range expected {
+		if binary.LittleEndian.Uint32(data[i*4:]) != serial {
+			t.Fatal("ranges not match")
+		}
+	}
+	for serial := uint32(100); serial < 200; serial += 2 {
+		session.pending[serial] = &Packet{serial: serial}
+	}
+	if len(session.sackRanges()) != MAX_SACK_RANGES*8 {
+		t.Fatal("ranges not bounded")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	version, features := Negotiate(PROTOCOL_VERSION+1, FEATURE_OBFUSCATION|1<<31)
+	if version != PROTOCOL_VERSION || features != FEATURE_OBFUSCATION {
+		t.Fatal("newer client not served")
+	}
+	if version, _ = Negotiate(MIN_PROTOCOL_VERSION-1, 0); version != 0 {
+		t.Fatal("old client served")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm1 := NewComm(conn1, key1, key2, FEATURE_COMPRESSION)
+	comm2 := NewComm(conn2, key2, key1, FEATURE_COMPRESSION)
+	session1 := comm1.NewSession(-1, nil, nil)
+	random := make([]byte, 1024)
+	rand.Read(random)
+	n := 128
+	for i := 0; i < n; i++ {
+		data := bytes.Repeat([]byte(fmt.Sprintf("line %d of a log\n", i)), 32)
+		if i%2 == 0 {
+			data = random
+		}
+		session1.Send(data)
+	}
+	for x := 0; x < n; {
+		var ev Event
+		select {
+		case ev = <-comm2.Events:
+		case <-time.After(time.Second * 1):
+			t.Fatal("event timeout")
+		}
+		if ev.Type == ERROR {
+			t.Fatal(string(ev.Data))
+		}
+		if ev.Type != DATA {
+			continue
+		}
+		expected := bytes.Repeat([]byte(fmt.Sprintf("line %d of a log\n", x)), 32)
+		if x%2 == 0 {
+			expected = random
+		}
+		if !bytes.Equal(ev.Data, expected) {
+			t.Fatal("data not match")
+		}
+		x += 1
+	}
+	if comm1.UncompressedSent != comm2.UncompressedReceived || comm1.CompressedSent != comm2.CompressedReceived {
+		t.Fatal("counters not match")
+	}
+	// the random half is sent as is
+	if comm1.CompressedSent < uint64(n/2*len(random)) || comm1.CompressedSent > comm1.UncompressedSent*3/4 {
+		t.Fatalf("%d bytes compressed to %d", comm1.UncompressedSent, comm1.CompressedSent)
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestFragmentation(t *testing.T) {
+	for _, features := range []uint32{0, FEATURE_COMPRESSION | FEATURE_OBFUSCATION} {
+		conn1, conn2 := net.Pipe()
+		key1 := bytes.Repeat([]byte("foo bar "), 3)
+		key2 := bytes.Repeat([]byte("bar foo "), 3)
+		comm1 := NewComm(conn1, key1, key2, features)
+		comm2 := NewComm(conn2, key2, key1, features)
+		session1 := comm1.NewSession(-1, nil, nil)
+		random := make([]byte, 200000)
+		rand.Read(random)
+		text := bytes.Repeat([]byte("a long line of text "), 10000)
+		messages := [][]byte{random, []byte("short"), text, random[:MAX_FRAGMENT_LENGTH], random[:MAX_FRAGMENT_LENGTH+1]}
+		for _, data := range messages {
+			session1.Send(data)
+		}
+		for x := 0; x < len(messages); {
+			var ev Event
+			select {
+			case ev = <-comm2.Events:
+			case <-time.After(time.Second * 2):
+				t.Fatal("event timeout")
+			}
+			if ev.Type == ERROR {
+				t.Fatal(string(ev.Data))
+			}
+			if ev.Type != DATA {
+				continue
+			}
+			if !bytes.Equal(ev.Data, messages[x]) {
+				t.Fatalf("message %d not match, %d bytes", x, len(ev.Data))
+			}
+			x += 1
+		}
+		comm1.Close()
+		comm2.Close()
+	}
+}
+
+func TestPriority(t *testing.T) {
+	conn1, conn2 := net.Pipe()
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	comm1 := NewComm(conn1, key1, key2, FEATURE_PRIORITY)
+	comm2 := NewComm(conn2, key2, key1, FEATURE_PRIORITY)
+	session1 := comm1.NewSession(-1, nil, nil)
+	session1.SetPriority(PRIORITY_HIGH)
+	session1.Signal(0)
+	for {
+		var ev Event
+		select {
+		case ev = <-comm2.Events:
+		case <-time.After(time.Second * 1):
+			t.Fatal("event timeout")
+		}
+		if ev.Type == ERROR {
+			t.Fatal(string(ev.Data))
+		}
+		if ev.Type == SIGNAL {
+			if ev.Session.priority != uint32(PRIORITY_HIGH) {
+				t.Fatal("priority not passed on")
+			}
+			break
+		}
+	}
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestLastActive(t *testing.T) {
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	conn1, conn2 := net.Pipe()
+	comm1 := NewComm(conn1, key1, key2, 0)
+	comm2 := NewComm(conn2, key2, key1, 0)
+	session1 := comm1.NewSession(-1, nil, nil)
+	var session2 *Session
+	select {
+	case ev := <-comm2.Events:
+		session2 = ev.Session
+	case <-time.After(time.Second * 1):
+		t.Fatal("event timeout")
+	}
+	time.Sleep(time.Millisecond * 50)
+	before := time.Now()
+	if session1.LastActive().After(before) || session2.LastActive().After(before) {
+		t.Fatal("active without packets")
+	}
+	// data counts on both sides
+	session1.Send([]byte("hello"))
+	select {
+	case <-comm2.Events:
+	case <-time.After(time.Second * 1):
+		t.Fatal("event timeout")
+	}
+	if session1.LastActive().Before(before) || session2.LastActive().Before(before) {
+		t.Fatal("not active after data")
+	}
+	comm1.Close()
+	comm2.Close()
 }
@@ -0,0 +1,218 @@
+package session
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Stress tests, meant to be run with -race. Sessions are used from
+// goroutines of their own while connections come and go, and the state of
+// the comms is watched from another goroutine, like the UI does.
+
+// stressReceiver reads the events of comm, checking that the data of each
+// session comes in order, and closes a session on its close signal. It
+// sends the number of messages of each closed session on done, and an
+// error on failed.
+func stressReceiver(comm *Comm, done chan<- int, failed chan<- error) {
+	received := make(map[int64]int)
+	for ev := range comm.Events {
+		switch ev.Type {
+		case SESSION:
+			received[ev.Session.Id] = 0
+		case DATA:
+			x := received[ev.Session.Id]
+			if !bytes.Equal(ev.Data, stressMessage(ev.Session.Id, x)) {
+				failed <- fmt.Errorf("session %d data %d not match", ev.Session.Id, x)
+				return
+			}
+			received[ev.Session.Id] = x + 1
+			ev.Session.Consumed(len(ev.Data))
+		case SIGNAL:
+			ev.Session.Close()
+			done <- received[ev.Session.Id]
+		case ERROR:
+			failed <- fmt.Errorf("%s", ev.Data)
+			return
+		}
+	}
+}
+
+// stressMessage is the data of message x of a session, of varied length
+func stressMessage(id int64, x int) []byte {
+	return bytes.Repeat([]byte(fmt.Sprintf("%d-%d ", id, x)), 1+x%97)
+}
+
+// stressSender sends n messages on a new session of comm, then the close
+// signal. It moves the session between priority classes as it goes.
+func stressSender(comm *Comm, n int) *Session {
+	session := comm.NewSession(-1, nil, nil)
+	go func() {
+		for x := 0; x < n && session.WaitCredit(); x++ {
+			if x%50 == 0 {
+				session.SetPriority(uint8(x / 50 % priorities))
+			}
+			session.Send(stressMessage(session.Id, x))
+		}
+		session.Signal(0)
+	}()
+	return session
+}
+
+// stressWatcher reads the state of comm until stop is closed
+func stressWatcher(comm *Comm, stop <-chan struct{}) {
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		for _, session := range comm.Sessions() {
+			_ = session.StartTime
+		}
+		comm.SessionCount()
+		comm.Conns()
+		comm.LastReadTime()
+		atomic.LoadUint64(&comm.BytesSent)
+		atomic.LoadUint64(&comm.Retransmits)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStressLinks(t *testing.T) {
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	conn1, conn2 := net.Pipe()
+	comm1 := NewComm(conn1, key1, key2, FEATURE_PRIORITY|FEATURE_COMPRESSION)
+	comm2 := NewComm(conn2, key2, key1, FEATURE_PRIORITY|FEATURE_COMPRESSION)
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn1, conn2 := net.Pipe()
+		comm1.AddConn(conn1, key1, key2, FEATURE_PRIORITY|FEATURE_COMPRESSION)
+		comm2.AddConn(conn2, key2, key1, FEATURE_PRIORITY|FEATURE_COMPRESSION)
+		conns = append(conns, conn1)
+	}
+	stop := make(chan struct{})
+	go stressWatcher(comm1, stop)
+	go stressWatcher(comm2, stop)
+	done := make(chan int)
+	failed := make(chan error, 1)
+	go stressReceiver(comm2, done, failed)
+
+	sessions, n := 16, 500
+	var senders []*Session
+	for i := 0; i < sessions; i++ {
+		senders = append(senders, stressSender(comm1, n))
+	}
+	dropped := time.After(time.Millisecond * 100)
+	for closed := 0; closed < sessions; {
+		select {
+		case x := <-done:
+			if x != n {
+				t.Fatalf("%d of %d messages received", x, n)
+			}
+			closed++
+		case <-dropped: // losing connections loses nothing
+			conns[0].Close()
+			conns[1].Close()
+		case err := <-failed:
+			t.Fatal(err)
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timeout after %d sessions", closed)
+		}
+	}
+	for _, session := range senders {
+		session.Close()
+	}
+	if comm1.SessionCount() != 0 {
+		t.Fatalf("%d sessions left", comm1.SessionCount())
+	}
+	close(stop)
+	comm1.Close()
+	comm2.Close()
+}
+
+func TestStressUseConn(t *testing.T) {
+	WINDOW = 16 * 1024
+	defer func() { WINDOW = uint64(256 * 1024) }()
+	// acks come between the resets, which restart the acker
+	ACK_INTERVAL = time.Millisecond * 10
+	defer func() { ACK_INTERVAL = time.Millisecond * 500 }()
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	getConns := func() (net.Conn, net.Conn) {
+		accepted := make(chan net.Conn)
+		go func() {
+			conn, err := ln.Accept()
+			if err != nil {
+				conn = nil
+			}
+			accepted <- conn
+		}()
+		conn1, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn2 := <-accepted
+		if conn2 == nil {
+			t.Fatal("accept failed")
+		}
+		return conn1, conn2
+	}
+	key1 := bytes.Repeat([]byte("foo bar "), 3)
+	key2 := bytes.Repeat([]byte("bar foo "), 3)
+	conn1, conn2 := getConns()
+	comm1 := NewComm(conn1, key1, key2, FEATURE_PRIORITY)
+	comm2 := NewComm(conn2, key2, key1, FEATURE_PRIORITY)
+	stop := make(chan struct{})
+	go stressWatcher(comm1, stop)
+	go stressWatcher(comm2, stop)
+	done := make(chan int)
+	failed := make(chan error, 1)
+	go stressReceiver(comm2, done, failed)
+
+	sessions, n := 4, 5000
+	for i := 0; i < sessions; i++ {
+		stressSender(comm1, n)
+	}
+	// the comms resume on new connections while sessions send, both
+	// sides at once
+	reset := time.NewTicker(time.Millisecond * 50)
+	defer reset.Stop()
+	for closed := 0; closed < sessions; {
+		select {
+		case x := <-done:
+			if x != n {
+				t.Fatalf("%d of %d messages received", x, n)
+			}
+			closed++
+		case <-reset.C:
+			conn1, conn2 := getConns()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go func() {
+				comm1.UseConn(conn1, key1, key2, FEATURE_PRIORITY)
+				wg.Done()
+			}()
+			go func() {
+				comm2.UseConn(conn2, key2, key1, FEATURE_PRIORITY)
+				wg.Done()
+			}()
+			wg.Wait()
+		case err := <-failed:
+			t.Fatal(err)
+		case <-time.After(time.Second * 10):
+			t.Fatalf("timeout after %d sessions", closed)
+		}
+	}
+	close(stop)
+	comm1.Close()
+	comm2.Close()
+}
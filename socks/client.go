@@ -8,3 +8,9 @@ type Client struct {
 	Conn     *net.TCPConn
 	HostPort string
 }
+
+// Reply answers the request of the client with rep, one of REP_*, and the
+// address bound for the connection, or nil if there is none.
+func (self *Client) Reply(rep byte, bound *net.TCPAddr) error {
+	return writeAck(self.Conn, rep, bound)
+}
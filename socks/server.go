@@ -9,17 +9,18 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
 type Server struct {
 	ln        *net.TCPListener
-	isStopped bool
+	stopped   int32 // set by Close for the accepting goroutine, accessed atomically
 	Clients   <-chan *Client
 	ClientsIn chan *Client
 }
 
 func (self *Server) Close() {
-	self.isStopped = true
+	atomic.StoreInt32(&self.stopped, 1)
 	self.ln.Close()
 }
 
@@ -28,26 +29,48 @@ func New(listenAddr string) (*Server, error) {
 		ClientsIn: make(chan *Client),
 	}
 	server.Clients = utils.MakeChan(server.ClientsIn).(<-chan *Client)
+	ln, err := server.listen(listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	server.ln = ln
+	return server, nil
+}
+
+// Rebind moves the server to listenAddr. Clients keep coming on Clients, and
+// those accepted on the old address are left alone.
+func (self *Server) Rebind(listenAddr string) error {
+	ln, err := self.listen(listenAddr)
+	if err != nil {
+		return err
+	}
+	old := self.ln
+	self.ln = ln
+	old.Close()
+	return nil
+}
+
+// listen accepts clients on listenAddr until the listener is closed
+func (self *Server) listen(listenAddr string) (*net.TCPListener, error) {
 	addr, err := net.ResolveTCPAddr("tcp", listenAddr)
 	if err != nil {
-		return nil, server.newError(err)
+		return nil, self.newError(err)
 	}
 	ln, err := net.ListenTCP("tcp", addr)
 	if err != nil {
-		return nil, server.newError(err)
+		return nil, self.newError(err)
 	}
-	server.ln = ln
 	go func() {
 		for {
 			conn, err := ln.AcceptTCP()
 			if err != nil {
-				if server.isStopped {
+				if atomic.LoadInt32(&self.stopped) != 0 || errors.Is(err, net.ErrClosed) { // closed or rebound
 					return
 				}
 				continue
 			}
 			go func() {
-				err := server.handshake(conn)
+				err := self.handshake(conn)
 				if err != nil {
 					conn.Close()
 					return
@@ -55,7 +78,7 @@ func New(listenAddr string) (*Server, error) {
 			}()
 		}
 	}()
-	return server, nil
+	return ln, nil
 }
 
 func (self *Server) newError(args ...interface{}) error {
@@ -131,7 +154,7 @@ func (self *Server) handshake(conn *net.TCPConn) error {
 		return self.newError("handshake")
 	}
 	if addrType != ADDR_TYPE_IP && addrType != ADDR_TYPE_DOMAIN && addrType != ADDR_TYPE_IPV6 {
-		writeAck(conn, REP_ADDRESS_TYPE_NOT_SUPPORTED)
+		writeAck(conn, REP_ADDRESS_TYPE_NOT_SUPPORTED, nil)
 		return self.newError("handshake")
 	}
 
@@ -167,11 +190,11 @@ func (self *Server) handshake(conn *net.TCPConn) error {
 	}
 
 	if cmd != CMD_CONNECT {
-		writeAck(conn, REP_COMMAND_NOT_SUPPORTED)
+		writeAck(conn, REP_COMMAND_NOT_SUPPORTED, nil)
 		return self.newError("handshake")
 	}
-	writeAck(conn, REP_SUCCEED)
 
+	// replied with Client.Reply once the target is connected
 	client := &Client{
 		Conn:     conn,
 		HostPort: hostPort,
@@ -181,28 +204,20 @@ func (self *Server) handshake(conn *net.TCPConn) error {
 	return nil
 }
 
-func writeAck(conn *net.TCPConn, reply byte) error {
-	err := binary.Write(conn, binary.BigEndian, VERSION)
-	if err != nil {
-		return errors.New("")
-	}
-	err = binary.Write(conn, binary.BigEndian, reply)
-	if err != nil {
-		return errors.New("")
-	}
-	err = binary.Write(conn, binary.BigEndian, RESERVED)
-	if err != nil {
-		return errors.New("")
-	}
-	err = binary.Write(conn, binary.BigEndian, ADDR_TYPE_IP)
-	if err != nil {
-		return errors.New("")
-	}
-	err = binary.Write(conn, binary.BigEndian, [4]byte{0, 0, 0, 0})
-	if err != nil {
-		return errors.New("")
+func writeAck(conn *net.TCPConn, reply byte, bound *net.TCPAddr) error {
+	addrType, ip, port := ADDR_TYPE_IP, net.IP{0, 0, 0, 0}, 0
+	if bound != nil && len(bound.IP) > 0 {
+		port = bound.Port
+		if ip = bound.IP.To4(); ip == nil {
+			addrType, ip = ADDR_TYPE_IPV6, bound.IP.To16()
+		}
 	}
-	err = binary.Write(conn, binary.BigEndian, uint16(0))
+	// in one write, as some clients read the reply with a single read
+	buf := new(bytes.Buffer)
+	buf.Write([]byte{VERSION, reply, RESERVED, addrType})
+	buf.Write(ip)
+	binary.Write(buf, binary.BigEndian, uint16(port))
+	_, err := conn.Write(buf.Bytes())
 	if err != nil {
 		return errors.New("")
 	}
@@ -1,13 +1,16 @@
 package socks
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
 
 func TestSocks(t *testing.T) {
-	server, err := New("localhost:54321")
+	server, err := New("localhost:0")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -15,9 +18,92 @@ func TestSocks(t *testing.T) {
 	for {
 		select {
 		case client := <-server.Clients:
-			fmt.Printf("%s\n", client)
+			fmt.Printf("%v\n", client)
 		case <-time.After(time.Second * 1):
 			return
 		}
 	}
 }
+
+func TestReply(t *testing.T) {
+	server, err := New("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	conn, err := net.Dial("tcp", server.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{VERSION, 1, METHOD_NOT_REQUIRED})
+	conn.Write([]byte{VERSION, CMD_CONNECT, RESERVED, ADDR_TYPE_DOMAIN, 7})
+	conn.Write([]byte("foo.bar"))
+	conn.Write([]byte{0, 80})
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	client := <-server.Clients
+	if client.HostPort != "foo.bar:80" {
+		t.Fatal("wrong host port", client.HostPort)
+	}
+	// no reply before the target is connected
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+		t.Fatal("replied too early")
+	}
+	conn.SetReadDeadline(time.Time{})
+	client.Reply(REP_CONNECTION_REFUSED, &net.TCPAddr{IP: net.ParseIP("::1"), Port: 1080})
+	reply := make([]byte, 22)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	expected := append([]byte{VERSION, REP_CONNECTION_REFUSED, RESERVED, ADDR_TYPE_IPV6}, net.ParseIP("::1")...)
+	expected = append(expected, 4, 56)
+	if !bytes.Equal(reply, expected) {
+		t.Fatal("wrong reply", reply)
+	}
+}
+
+// freeAddr returns an address on localhost no one listens on
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestRebind(t *testing.T) {
+	server, err := New("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	oldAddr, newAddr := server.ln.Addr().String(), freeAddr(t)
+	if err = server.Rebind(newAddr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = net.Dial("tcp", oldAddr); err == nil {
+		t.Fatal("old address still listening")
+	}
+	conn, err := net.Dial("tcp", newAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{VERSION, 1, METHOD_NOT_REQUIRED})
+	conn.Write([]byte{VERSION, CMD_CONNECT, RESERVED, ADDR_TYPE_DOMAIN, 7})
+	conn.Write([]byte("foo.bar"))
+	conn.Write([]byte{0, 80})
+	select {
+	case client := <-server.Clients:
+		if client.HostPort != "foo.bar:80" {
+			t.Fatal("wrong host port", client.HostPort)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("no client on the new address")
+	}
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var ErrClosed = errors.New("<Transport> pipe listener closed")
+
+// Pipe returns an in-memory transport. Every Dial returns one end of a
+// net.Pipe whose other end is accepted by the listener; addresses are
+// ignored. Closing the listener closes the transport. It is meant for tests.
+func Pipe() Transport {
+	return &pipe{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+type pipe struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (self *pipe) Dial(addr string) (net.Conn, error) {
+	conn1, conn2 := net.Pipe()
+	select {
+	case self.conns <- conn2:
+		return conn1, nil
+	case <-self.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (self *pipe) Listen(addr string) (net.Listener, error) {
+	return self, nil
+}
+
+func (self *pipe) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.closed:
+		return nil, ErrClosed
+	}
+}
+
+func (self *pipe) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+	return nil
+}
+
+func (self *pipe) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("tls", NewTLS)
+}
+
+// TLS wraps connections in TLS.
+//
+// The server side needs "tls_cert" and "tls_key", paths of a PEM certificate
+// and key. If neither file exists, a self-signed certificate is generated
+// and saved there.
+//
+// The client side checks the server certificate against "tls_pin", the hex
+// sha256 fingerprint of the certificate, if set. Otherwise the certificate
+// chain is verified against the CA bundle in "tls_ca", or the system roots
+// if that is not set either. "tls_server_name" overrides the host name
+// checked in the certificate.
+type TLS struct {
+	config      map[string]string
+	certificate *tls.Certificate
+}
+
+func NewTLS(config map[string]string) (Transport, error) {
+	return &TLS{
+		config: config,
+	}, nil
+}
+
+func (self *TLS) Dial(addr string) (net.Conn, error) {
+	tlsConfig := &tls.Config{
+		ServerName: self.config["tls_server_name"],
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = host
+	}
+	if pin := self.config["tls_pin"]; pin != "" {
+		expected, err := parseFingerprint(pin)
+		if err != nil {
+			return nil, err
+		}
+		// the pin replaces chain and host name verification
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("<Transport> no server certificate")
+			}
+			if Fingerprint(state.PeerCertificates[0].Raw) != expected {
+				return errors.New("<Transport> server certificate does not match tls_pin")
+			}
+			return nil
+		}
+	} else if ca := self.config["tls_ca"]; ca != "" {
+		bundle, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, errors.New("<Transport> no certificate in tls_ca " + ca)
+		}
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: DIAL_TIMEOUT}, "tcp", addr, tlsConfig)
+}
+
+func (self *TLS) Listen(addr string) (net.Listener, error) {
+	if self.certificate == nil {
+		err := self.loadCertificate()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return tls.Listen("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{*self.certificate},
+		MinVersion:   tls.VersionTLS12,
+	})
+}
+
+// Fingerprint returns the hex sha256 of a DER certificate, the format of
+// "tls_pin".
+func Fingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// ServerFingerprint returns the fingerprint of the server certificate,
+// loading or generating it first.
+func (self *TLS) ServerFingerprint() (string, error) {
+	if self.certificate == nil {
+		err := self.loadCertificate()
+		if err != nil {
+			return "", err
+		}
+	}
+	return Fingerprint(self.certificate.Certificate[0]), nil
+}
+
+func parseFingerprint(s string) (string, error) {
+	s = strings.ToLower(strings.Replace(s, ":", "", -1))
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != sha256.Size {
+		return "", errors.New("<Transport> tls_pin is not a sha256 fingerprint")
+	}
+	return s, nil
+}
+
+func (self *TLS) loadCertificate() error {
+	certFile, keyFile := self.config["tls_cert"], self.config["tls_key"]
+	if certFile == "" || keyFile == "" {
+		return errors.New("<Transport> tls_cert and tls_key are required to listen")
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		err := generateCertificate(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	self.certificate = &certificate
+	return nil
+}
+
+// generate a self-signed certificate, to be pinned by clients
+func generateCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "gotunnel"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour * 24 * 365 * 10),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
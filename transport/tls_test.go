@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSPin(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := map[string]string{
+		"tls_cert": filepath.Join(dir, "cert.pem"),
+		"tls_key":  filepath.Join(dir, "key.pem"),
+	}
+	trans, _ := NewTLS(config)
+	fingerprint, err := trans.(*TLS).ServerFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(config["tls_cert"]); err != nil {
+		t.Fatal("certificate not saved")
+	}
+
+	config["tls_pin"] = fingerprint
+	testTransport(t, trans, "localhost:0")
+
+	// wrong pin
+	config["tls_pin"] = Fingerprint([]byte("foo"))
+	ln, err := trans.Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Write([]byte("hello"))
+			conn.Close()
+		}
+	}()
+	if conn, err := trans.Dial(ln.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("wrong pin accepted")
+	}
+}
+
+func TestTLSCA(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	config := map[string]string{
+		"tls_cert": filepath.Join(dir, "cert.pem"),
+		"tls_key":  filepath.Join(dir, "key.pem"),
+		"tls_ca":   filepath.Join(dir, "cert.pem"),
+
+		"tls_server_name": "localhost",
+	}
+	ioutil.WriteFile(config["tls_cert"], pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(config["tls_key"], pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	trans, _ := New("tls", config)
+	testTransport(t, trans, "localhost:0")
+}
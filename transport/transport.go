@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DIAL_TIMEOUT bounds a Dial, including the handshake of the transport
+var DIAL_TIMEOUT = time.Second * 10
+
+// Transport carries Comm connections between local and server.
+type Transport interface {
+	Dial(addr string) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// Factory makes a transport from the program config.
+type Factory func(config map[string]string) (Transport, error)
+
+var (
+	factories     = make(map[string]Factory)
+	factoriesLock sync.Mutex
+)
+
+func init() {
+	Register("tcp", func(config map[string]string) (Transport, error) {
+		return &netTransport{"tcp"}, nil
+	})
+	Register("unix", func(config map[string]string) (Transport, error) {
+		return &netTransport{"unix"}, nil
+	})
+}
+
+// Register makes a transport available by name.
+func Register(name string, factory Factory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[name] = factory
+}
+
+// New returns the transport registered as name.
+func New(name string, config map[string]string) (Transport, error) {
+	factoriesLock.Lock()
+	factory, ok := factories[name]
+	factoriesLock.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("<Transport> unknown transport %s", name))
+	}
+	return factory(config)
+}
+
+// transport over a stream network of package net
+type netTransport struct {
+	network string
+}
+
+func (self *netTransport) Dial(addr string) (net.Conn, error) {
+	return net.DialTimeout(self.network, addr, DIAL_TIMEOUT)
+}
+
+func (self *netTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(self.network, addr)
+}
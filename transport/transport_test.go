@@ -0,0 +1,80 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testTransport(t *testing.T, trans Transport, addr string) {
+	ln, err := trans.Listen(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if addr == "" || addr == "localhost:0" {
+		addr = ln.Addr().String()
+	}
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	conn, err := trans.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello" {
+		t.Fatal("data not match")
+	}
+}
+
+func TestTCP(t *testing.T) {
+	trans, err := New("tcp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, trans, "localhost:0")
+}
+
+func TestUnix(t *testing.T) {
+	trans, err := New("unix", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := os.MkdirTemp("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testTransport(t, trans, filepath.Join(dir, "sock"))
+}
+
+func TestPipe(t *testing.T) {
+	trans := Pipe()
+	testTransport(t, trans, "")
+	ln, _ := trans.Listen("")
+	ln.Close()
+	if _, err := trans.Dial(""); err != ErrClosed {
+		t.Fatal("dial after close")
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	if _, err := New("carrier pigeon", nil); err == nil {
+		t.Fatal("unknown transport")
+	}
+}
+
+var _ net.Listener = new(pipe)
@@ -0,0 +1,317 @@
+package transport
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = byte(0x0)
+	wsOpText         = byte(0x1)
+	wsOpBinary       = byte(0x2)
+	wsOpClose        = byte(0x8)
+	wsOpPing         = byte(0x9)
+	wsOpPong         = byte(0xa)
+
+	WS_MAX_FRAME_LENGTH = 1 << 20
+)
+
+func init() {
+	Register("ws", func(config map[string]string) (Transport, error) {
+		return NewWebSocket(&netTransport{"tcp"}, config), nil
+	})
+	Register("wss", func(config map[string]string) (Transport, error) {
+		tlsTrans, err := NewTLS(config)
+		if err != nil {
+			return nil, err
+		}
+		return NewWebSocket(tlsTrans, config), nil
+	})
+}
+
+// WebSocket carries connections in binary WebSocket messages over another
+// transport, so they pass HTTP-only proxies. "ws" runs over tcp and "wss"
+// over tls. The upgrade request goes to "ws_path", "/" by default; the
+// server answers anything else with 404, so it can sit behind a reverse
+// proxy that forwards that path.
+type WebSocket struct {
+	base Transport
+	path string
+}
+
+func NewWebSocket(base Transport, config map[string]string) *WebSocket {
+	path := config["ws_path"]
+	if path == "" {
+		path = "/"
+	}
+	return &WebSocket{
+		base: base,
+		path: path,
+	}
+}
+
+func (self *WebSocket) Dial(addr string) (net.Conn, error) {
+	deadline := time.Now().Add(DIAL_TIMEOUT)
+	conn, err := self.base.Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(deadline) // for the upgrade
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	req, err := http.NewRequest("GET", "http://"+addr+self.path, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, errors.New("<Transport> websocket upgrade refused: " + resp.Status)
+	}
+	conn.SetDeadline(time.Time{})
+	return newWSConn(conn, reader, true), nil
+}
+
+func (self *WebSocket) Listen(addr string) (net.Listener, error) {
+	ln, err := self.base.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	wsLn := &wsListener{
+		Listener: ln,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(self.path, wsLn.upgrade)
+	go http.Serve(ln, mux)
+	return wsLn, nil
+}
+
+func wsAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+type wsListener struct {
+	net.Listener
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (self *wsListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || key == "" ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "cannot upgrade", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case self.conns <- newWSConn(conn, rw.Reader, false):
+	case <-self.closed:
+		conn.Close()
+	}
+}
+
+func (self *wsListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.closed:
+		return nil, errors.New("<Transport> websocket listener closed")
+	}
+}
+
+func (self *wsListener) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closed)
+	})
+	return self.Listener.Close()
+}
+
+// wsConn is a net.Conn over WebSocket frames. Every Write is sent as one
+// binary message; Read returns message payloads as a stream.
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	isClient  bool // clients mask what they send
+	writeLock sync.Mutex
+	remaining uint64 // unread payload of the current frame
+	mask      []byte
+	maskPos   int
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader, isClient bool) *wsConn {
+	return &wsConn{
+		Conn:     conn,
+		reader:   reader,
+		isClient: isClient,
+	}
+}
+
+func (self *wsConn) Read(b []byte) (int, error) {
+	for self.remaining == 0 {
+		err := self.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(b)) > self.remaining {
+		b = b[:self.remaining]
+	}
+	n, err := self.reader.Read(b)
+	if self.mask != nil {
+		for i := 0; i < n; i++ {
+			b[i] ^= self.mask[self.maskPos%4]
+			self.maskPos++
+		}
+	}
+	self.remaining -= uint64(n)
+	return n, err
+}
+
+// read frame headers until a data frame, answering control frames
+func (self *wsConn) nextFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(self.reader, header[:]); err != nil {
+		return err
+	}
+	op := header[0] & 0xf
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var l uint16
+		if err := binary.Read(self.reader, binary.BigEndian, &l); err != nil {
+			return err
+		}
+		length = uint64(l)
+	case 127:
+		if err := binary.Read(self.reader, binary.BigEndian, &length); err != nil {
+			return err
+		}
+	}
+	if length > WS_MAX_FRAME_LENGTH {
+		return errors.New("<Transport> websocket frame too long")
+	}
+	self.mask = nil
+	self.maskPos = 0
+	if masked {
+		self.mask = make([]byte, 4)
+		if _, err := io.ReadFull(self.reader, self.mask); err != nil {
+			return err
+		}
+	}
+	switch op {
+	case wsOpBinary, wsOpText, wsOpContinuation:
+		self.remaining = length
+		return nil
+	}
+	// control frame
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(self.reader, payload); err != nil {
+		return err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= self.mask[i%4]
+		}
+	}
+	switch op {
+	case wsOpPing:
+		return self.writeFrame(wsOpPong, payload)
+	case wsOpClose:
+		self.writeFrame(wsOpClose, nil)
+		return io.EOF
+	}
+	return nil
+}
+
+func (self *wsConn) Write(b []byte) (int, error) {
+	err := self.writeFrame(wsOpBinary, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (self *wsConn) writeFrame(op byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+	var maskBit byte
+	if self.isClient {
+		maskBit = 0x80
+	}
+	l := len(payload)
+	switch {
+	case l < 126:
+		frame = append(frame, maskBit|byte(l))
+	case l <= 0xffff:
+		frame = append(frame, maskBit|126, byte(l>>8), byte(l))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(l))
+	}
+	if self.isClient {
+		mask := make([]byte, 4)
+		rand.Read(mask)
+		frame = append(frame, mask...)
+		for i, c := range payload {
+			frame = append(frame, c^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	_, err := self.Conn.Write(frame)
+	return err
+}
@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWebSocket(t *testing.T) {
+	trans, err := New("ws", map[string]string{"ws_path": "/tunnel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, trans, "localhost:0")
+
+	// large messages and many small ones
+	ln, err := trans.Listen("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	conn, err := trans.Dial(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	data := bytes.Repeat([]byte("websocket"), 100000)
+	go func() {
+		conn.Write(data[:100])
+		conn.Write(data[100:70000])
+		conn.Write(data[70000:])
+	}()
+	buf := make([]byte, len(data))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatal("data not match")
+	}
+
+	// plain http requests are refused
+	resp, err := http.Get("http://" + ln.Addr().String() + "/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("plain request accepted")
+	}
+	resp, err = http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatal("wrong path accepted")
+	}
+}
+
+func TestWebSocketTLS(t *testing.T) {
+	dir, err := os.MkdirTemp("", "transport")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := map[string]string{
+		"tls_cert": filepath.Join(dir, "cert.pem"),
+		"tls_key":  filepath.Join(dir, "key.pem"),
+	}
+	tlsTrans, _ := NewTLS(config)
+	config["tls_pin"], err = tlsTrans.(*TLS).ServerFingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans, err := New("wss", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testTransport(t, trans, "localhost:0")
+}
+
+func TestWebSocketDialTimeout(t *testing.T) {
+	DIAL_TIMEOUT = time.Millisecond * 200
+	defer func() { DIAL_TIMEOUT = time.Second * 10 }()
+	// a server that accepts and never upgrades
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	trans, err := New("ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		_, err := trans.Dial(ln.Addr().String())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("dial without upgrade succeeded")
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("dial not timed out")
+	}
+}
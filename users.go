@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+type UserStats struct {
+	Sessions      uint64
+	Reaped        uint64 // sessions closed by the session policy
+	BytesSent     uint64
+	BytesReceived uint64
+}
+
+// Users maps user names to keys. The users file is a json object of user
+// name to key; it is reloaded whenever it changes. Without a users file,
+// every user name is accepted with the key from the config.
+type Users struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	keys    map[string]string
+	Stats   map[string]*UserStats
+}
+
+func NewUsers(path string) *Users {
+	users := &Users{
+		path:  path,
+		Stats: make(map[string]*UserStats),
+	}
+	users.Reload()
+	return users
+}
+
+// Reload reads the users file if it has changed since the last load. It
+// returns the users who were removed or whose key has changed.
+func (self *Users) Reload() (revoked []string, err error) {
+	self.Lock()
+	defer self.Unlock()
+	info, err := os.Stat(self.path)
+	if os.IsNotExist(err) {
+		if self.keys != nil {
+			for user := range self.keys {
+				revoked = append(revoked, user)
+			}
+		}
+		self.keys = nil
+		self.modTime = time.Time{}
+		return revoked, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.ModTime().Equal(self.modTime) {
+		return nil, nil
+	}
+	s, err := ioutil.ReadFile(self.path)
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]string)
+	err = json.Unmarshal(s, &keys)
+	if err != nil {
+		return nil, err
+	}
+	for user, key := range self.keys {
+		if newKey, ok := keys[user]; !ok || newKey != key {
+			revoked = append(revoked, user)
+		}
+	}
+	self.keys = keys
+	self.modTime = info.ModTime()
+	return revoked, nil
+}
+
+// Key returns the key of user, or nil if there is no such user.
+func (self *Users) Key(user string) []byte {
+	self.Lock()
+	defer self.Unlock()
+	if self.keys == nil {
+		return []byte(getConfig("key"))
+	}
+	key, ok := self.keys[user]
+	if !ok || key == "" {
+		return nil
+	}
+	return []byte(key)
+}
+
+// Account adds usage to a user's stats.
+func (self *Users) Account(user string, sessions, sent, received uint64) {
+	self.Lock()
+	defer self.Unlock()
+	stats := self.stats(user)
+	stats.Sessions += sessions
+	stats.BytesSent += sent
+	stats.BytesReceived += received
+}
+
+// Reaped counts a session of a user reaped by the session policy.
+func (self *Users) Reaped(user string) {
+	self.Lock()
+	defer self.Unlock()
+	self.stats(user).Reaped++
+}
+
+// stats returns the stats of user, called with the lock held
+func (self *Users) stats(user string) *UserStats {
+	stats, ok := self.Stats[user]
+	if !ok {
+		stats = new(UserStats)
+		self.Stats[user] = stats
+	}
+	return stats
+}